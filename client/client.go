@@ -1,30 +1,136 @@
+//go:generate go run . -diagrams ../diagrams
+
 package main
 
 import (
+	"comp7005_project/fsm"
 	"comp7005_project/utils"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"math"
 	"net"
 	"os"
+	"path/filepath"
+	"syscall"
 	"time"
 )
 
+// how long to linger for the server repeating its syn/ack or fin/ack
 const CLIENT_DELAY_SECONDS int = 2
 
+// bytes of the server's reply that can be buffered out of order
+const DEFAULT_RECEIVE_WINDOW int = 64 * 1024
+
+const DEFAULT_WINDOW_SIZE int = 64
+
+const DEFAULT_DUP_ACK_THRESHOLD int = 3
+
+// retransmissions in a row without hearing from the server before giving up
+const DEFAULT_RETRIES int = 8
+
+// exit code when the connection state machine fails validation at startup
+const EXIT_INVALID_FSM int = 1
+
+// exit code when the server stopped responding mid-connection
+const EXIT_PEER_DEAD int = 3
+
+// exit code when the server aborted the connection
+const EXIT_RESET int = 4
+
+// exit code when the client's own state machine refused what it was doing
+const EXIT_BAD_STATE int = 5
+
+// exit code when the server's limits leave too little room for data
+const EXIT_BAD_LIMITS int = 6
+
+// everything that moves the connection between states, each one is a packet
+// from the server, a timer running out or the client deciding to open or close
+const (
+	EVENT_SEND_SYN          = "send syn"
+	EVENT_SYN_TIMEOUT       = "syn timeout"
+	EVENT_RECEIVE_SYN_ACK   = "receive syn/ack"
+	EVENT_RECEIVE_ACK       = "receive ack"
+	EVENT_ACK_TIMEOUT       = "ack timeout"
+	EVENT_SEND_FIN          = "send fin"
+	EVENT_RECEIVE_REPLY     = "receive reply"
+	EVENT_FIN_TIMEOUT       = "fin timeout"
+	EVENT_RECEIVE_FIN       = "receive fin"
+	EVENT_TIME_WAIT_TIMEOUT = "time wait timeout"
+	EVENT_ABORT             = "abort"
+)
+
+var transitions = []fsm.Transitions{
+	{Name: EVENT_SEND_SYN, From: []string{utils.CLOSED}, To: utils.SYN_SENT},
+	{Name: EVENT_SYN_TIMEOUT, From: []string{utils.SYN_SENT}, To: utils.SYN_SENT},
+	{Name: EVENT_RECEIVE_SYN_ACK, From: []string{utils.SYN_SENT, utils.ESTABLISHED}, To: utils.ESTABLISHED},
+	{Name: EVENT_RECEIVE_ACK, From: []string{utils.ESTABLISHED}, To: utils.ESTABLISHED},
+	{Name: EVENT_ACK_TIMEOUT, From: []string{utils.ESTABLISHED}, To: utils.ESTABLISHED},
+	{Name: EVENT_SEND_FIN, From: []string{utils.ESTABLISHED}, To: utils.FIN_WAIT},
+	{Name: EVENT_RECEIVE_REPLY, From: []string{utils.FIN_WAIT}, To: utils.FIN_WAIT},
+	{Name: EVENT_FIN_TIMEOUT, From: []string{utils.FIN_WAIT}, To: utils.FIN_WAIT},
+	{Name: EVENT_RECEIVE_FIN, From: []string{utils.FIN_WAIT, utils.TIME_WAIT}, To: utils.TIME_WAIT},
+	{Name: EVENT_TIME_WAIT_TIMEOUT, From: []string{utils.TIME_WAIT}, To: utils.CLOSED, Timeout: time.Duration(CLIENT_DELAY_SECONDS) * time.Second},
+	{Name: EVENT_ABORT, From: []string{"*"}, To: utils.CLOSED},
+}
+
 type ClientCtx struct {
+	FSM               *fsm.FSM
 	Socket            *net.UDPConn
 	Address, Ip, Port string
 	FilePath          string
 	Data              string
+	WindowSize        int
+	Corrupted         int
+	RTO               *utils.RTOEstimator
+	Congestion        utils.CongestionController
+	Cwnd              int
+	PeerWindow        uint32
+	ISN               uint32
+
+	// Limits is what this side accepts, Negotiated is the smaller of it and
+	// what the server sent in its syn/ack
+	Limits, Negotiated utils.Limits
+	// options the server put in its syn/ack that this side also supports
+	Options utils.OptionSet
+	// the newest timestamp from the server, echoed back on every packet
+	TsRecent uint32
+	// the server's next sequence number, keepalive probes come one before it
+	PeerNext uint32
+
+	// timeouts since the server was last heard from
+	Retries, MaxRetries int
+
+	// the server's side of the connection, which it can keep sending on
+	// after the client's fin until it sends its own
+	ReceiveWindow int
+	Reply         *utils.ReceiveBuffer
+	ReplyPath     string
+	ReplyOutput   *utils.OutputFile
+	ReplyBytes    int
+	// the client's next sequence number once its fin is sent
+	SendNext uint32
+
+	// set while retransmitting the holes from one loss, so a burst of losses
+	// only shrinks the congestion window once
+	InRecovery bool
+	RecoverSeq uint32
+
+	// duplicate acks for the same byte, reaching the threshold resends the
+	// oldest segment without waiting for the timer
+	LastAck         uint32
+	DupAcks         int
+	DupAckThreshold int
 
 	DataToSend                   []string
 	packetsSent, packetsReceived []utils.Packet
 }
 
-func buildPackets(clientCtx *ClientCtx) []utils.Packet {
+func buildPackets(clientCtx *ClientCtx, seq uint32, ack uint32) []utils.Packet {
 	var packets []utils.Packet
 
-	chunkSize := 512
+	chunkSize := clientCtx.Negotiated.Payload()
 
 	for i := 0; i < len(clientCtx.Data); i += chunkSize {
 		chunkEnd := math.Min(float64(len(clientCtx.Data)), float64(i+chunkSize))
@@ -33,7 +139,7 @@ func buildPackets(clientCtx *ClientCtx) []utils.Packet {
 		packet := utils.Packet{
 			SrcAddr: clientCtx.Address,
 			DstAddr: clientCtx.Socket.LocalAddr().String(),
-			Header:  utils.Header{Flags: utils.Flags{PSH: true, ACK: true}, Seq: 0, Ack: 0, Len: uint32(len(chunk))},
+			Header:  utils.Header{Flags: utils.Flags{PSH: true, ACK: true}, Seq: seq + uint32(i), Ack: ack, Len: uint32(len(chunk))},
 			Data:    chunk,
 		}
 
@@ -47,22 +153,36 @@ func packetString(packet utils.Packet) string {
 	return fmt.Sprintf("[Seq: %d | Ack: %d]", packet.Header.Seq, packet.Header.Ack)
 }
 
+func sackString(packet utils.Packet) string {
+	blocks := ""
+	for _, block := range packet.Header.Sack {
+		if block.Start != block.End {
+			blocks += fmt.Sprintf(" %d-%d", block.Start, block.End)
+		}
+	}
+
+	if blocks == "" {
+		return ""
+	}
+	return " SACK:" + blocks
+}
+
 func sendSynPacket(clientCtx *ClientCtx) {
-	sendPacket(clientCtx, utils.Flags{SYN: true}, "", 0, 0)
+	sendPacket(clientCtx, utils.Flags{SYN: true}, "", clientCtx.ISN, 0)
 }
 
 func sendAckPacket(clientCtx *ClientCtx) {
 	lastPacketReceived := clientCtx.packetsReceived[len(clientCtx.packetsReceived)-1]
-	lastPacketSent := clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
 
-	sendPacket(clientCtx, utils.Flags{ACK: true}, "", lastPacketReceived.Header.Ack, lastPacketSent.Header.Ack+lastPacketReceived.Header.Len)
+	sendPacket(clientCtx, utils.Flags{ACK: true}, "", lastPacketReceived.Header.Ack, lastPacketReceived.Header.Seq+lastPacketReceived.Header.Len)
 }
 
-func sendDataPacket(clientCtx *ClientCtx, data string) {
-	lastPacketReceived := clientCtx.packetsReceived[len(clientCtx.packetsReceived)-1]
-	lastPacketSent := clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
+func sendSegment(clientCtx *ClientCtx, segment *utils.Segment) {
+	flags := segment.Packet.Header.Flags
+	flags.DUP = segment.Retransmitted
 
-	sendPacket(clientCtx, utils.Flags{PSH: true, ACK: true}, data, lastPacketReceived.Header.Ack, lastPacketSent.Header.Ack)
+	sendPacket(clientCtx, flags, segment.Packet.Data, segment.Packet.Header.Seq, segment.Packet.Header.Ack)
+	segment.SentAt = time.Now()
 }
 
 func sendFinPacket(clientCtx *ClientCtx) {
@@ -75,10 +195,16 @@ func sendFinPacket(clientCtx *ClientCtx) {
 func sendLastPacket(clientCtx *ClientCtx) {
 	lastPacketSent := clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
 
-	sendPacket(clientCtx, utils.Flags{SYN: lastPacketSent.Header.Flags.SYN, FIN: lastPacketSent.Header.Flags.FIN, ACK: lastPacketSent.Header.Flags.ACK, PSH: lastPacketSent.Header.Flags.PSH, DUP: true}, lastPacketSent.Data, lastPacketSent.Header.Seq, lastPacketSent.Header.Ack)
+	sendPacket(clientCtx, utils.Flags{SYN: lastPacketSent.Header.Flags.SYN, FIN: lastPacketSent.Header.Flags.FIN, ACK: lastPacketSent.Header.Flags.ACK, PSH: lastPacketSent.Header.Flags.PSH, DUP: true, RST: lastPacketSent.Header.Flags.RST}, lastPacketSent.Data, lastPacketSent.Header.Seq, lastPacketSent.Header.Ack)
 }
 
 func sendPacket(clientCtx *ClientCtx, flags utils.Flags, data string, seq uint32, ack uint32) {
+	packet := buildPacket(clientCtx, flags, data, seq, ack)
+	writePacket(clientCtx, packet)
+	clientCtx.packetsSent = append(clientCtx.packetsSent, packet)
+}
+
+func buildPacket(clientCtx *ClientCtx, flags utils.Flags, data string, seq uint32, ack uint32) utils.Packet {
 	length := len(data)
 
 	if length == 0 && (flags.SYN || flags.FIN) {
@@ -88,10 +214,29 @@ func sendPacket(clientCtx *ClientCtx, flags utils.Flags, data string, seq uint32
 	packet := utils.Packet{
 		SrcAddr: clientCtx.Address,
 		DstAddr: clientCtx.Socket.LocalAddr().String(),
-		Header:  utils.Header{Flags: flags, Seq: seq, Ack: ack, Len: uint32(length)},
+		Header:  utils.Header{Flags: flags, Seq: seq, Ack: ack, Len: uint32(length), Window: advertisedWindow(clientCtx)},
 		Data:    data,
 	}
+	if flags.SYN {
+		clientCtx.Limits.SetOptions(&packet.Header)
+	}
+	if flags.SYN || clientCtx.Options[utils.OPTION_TIMESTAMP] {
+		packet.Header.SetTimestamp(utils.Timestamp{Val: utils.TimestampNow(), Ecr: clientCtx.TsRecent})
+	}
+
+	return packet
+}
+
+// free space for the server's reply, which is written out as soon as it is in
+// order so only out of order segments take up room
+func advertisedWindow(clientCtx *ClientCtx) uint32 {
+	if clientCtx.Reply == nil {
+		return uint32(clientCtx.ReceiveWindow)
+	}
+	return uint32(max(0, clientCtx.ReceiveWindow-clientCtx.Reply.Buffered()))
+}
 
+func writePacket(clientCtx *ClientCtx, packet utils.Packet) {
 	bytes, err := utils.EncodePacket(packet)
 	if err != nil {
 		fmt.Println(err)
@@ -100,57 +245,163 @@ func sendPacket(clientCtx *ClientCtx, flags utils.Flags, data string, seq uint32
 
 	_, err = clientCtx.Socket.Write(bytes)
 	if err != nil {
-		fmt.Println(err)
-		cleanup(clientCtx)
+		socketError(clientCtx, err)
 	}
+}
 
-	clientCtx.packetsSent = append(clientCtx.packetsSent, packet)
+// answers a keepalive probe, it is not kept in packetsSent so it is never
+// what gets repeated by sendLastPacket
+func sendKeepaliveAck(clientCtx *ClientCtx, probe utils.Packet) {
+	packet := buildPacket(clientCtx, utils.Flags{ACK: true}, "", probe.Header.Ack, probe.Header.Seq+1)
+	writePacket(clientCtx, packet)
+	fmt.Println("Sent -> KEEPALIVE ACK:", packetString(packet))
 }
 
 func flagsMatch(flags1, flags2 utils.Flags) bool {
 	return (flags1.SYN == flags2.SYN) && (flags1.FIN == flags2.FIN) && (flags1.ACK == flags2.ACK) && (flags1.PSH == flags2.PSH)
 }
 
-// checks if the flags are as expected, false if no or timeout when receiving
-func hasReceivedPacket(clientCtx *ClientCtx, flags utils.Flags) bool {
-	buffer := make([]byte, 1024)
+// reads the next valid packet before the deadline, corrupt packets are counted
+// and dropped so retransmission can recover them, false on timeout
+func readPacket(clientCtx *ClientCtx, deadline time.Time) (utils.Packet, bool) {
+	buffer := make([]byte, clientCtx.Negotiated.Datagram)
 
-	deadline := time.Now().Add(time.Duration(CLIENT_DELAY_SECONDS) * time.Second)
 	clientCtx.Socket.SetReadDeadline(deadline)
 
-	n, _, err := clientCtx.Socket.ReadFromUDP(buffer)
-	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return false
-		} else {
+	for {
+		n, _, err := clientCtx.Socket.ReadFromUDP(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return utils.Packet{}, false
+			} else {
+				socketError(clientCtx, err)
+			}
+		}
+
+		packet, err := utils.DecodePacket(buffer[0:n])
+		if errors.Is(err, utils.ErrCorrupt) {
+			clientCtx.Corrupted++
+			fmt.Printf("Dropped corrupt packet (%d so far)\n", clientCtx.Corrupted)
+			continue
+		} else if err != nil {
 			fmt.Println(err)
 			cleanup(clientCtx)
 		}
+
+		if !checkTimestamp(clientCtx, packet) {
+			fmt.Println("Old duplicate rejected by PAWS:", packetString(packet))
+			continue
+		}
+
+		clientCtx.Retries = 0
+		if packet.Header.Flags.RST {
+			if !acceptableReset(clientCtx, packet) {
+				fmt.Println("Received -> RST outside the window, ignored:", packetString(packet))
+				continue
+			}
+			reset(clientCtx, packet)
+		}
+		if connected(clientCtx) && utils.IsKeepalive(packet, clientCtx.PeerNext) {
+			fmt.Println("Received -> KEEPALIVE:", packetString(packet))
+			sendKeepaliveAck(clientCtx, packet)
+			continue
+		}
+
+		clientCtx.packetsReceived = append(clientCtx.packetsReceived, packet)
+		if packet.Header.Flags.ACK && packet.Header.Flags.SYN {
+			clientCtx.PeerNext = packet.Header.Seq + 1
+			clientCtx.PeerWindow = packet.Header.Window
+			negotiated, err := clientCtx.Limits.Negotiate(&packet.Header)
+			if err != nil {
+				refuseLimits(clientCtx, err)
+			}
+			clientCtx.Negotiated = negotiated
+			clientCtx.Options = utils.SupportedOptions().Intersect(packet.Header.OptionSet())
+			fmt.Printf("Negotiated %s (%d bytes per segment), options: %s\n", clientCtx.Negotiated, clientCtx.Negotiated.Payload(), clientCtx.Options)
+		}
+		return packet, true
+	}
+}
+
+// false for a packet whose timestamp is older than one already seen, newer
+// timestamps are kept to be echoed back
+func checkTimestamp(clientCtx *ClientCtx, packet utils.Packet) bool {
+	timestamp, ok := packet.Header.Timestamp()
+	if !ok {
+		return true
 	}
 
-	bytes := buffer[0:n]
+	if !packet.Header.Flags.SYN && clientCtx.Options[utils.OPTION_TIMESTAMP] && utils.StaleTimestamp(timestamp.Val, clientCtx.TsRecent) {
+		return false
+	}
 
-	packet, err := utils.DecodePacket(bytes)
-	if err != nil {
-		fmt.Println(err)
-		cleanup(clientCtx)
+	// same as the server, a packet past the next sequence number expected can't
+	// move TsRecent forward
+	next := clientCtx.PeerNext
+	if clientCtx.Reply != nil {
+		next = clientCtx.Reply.Next
+	}
+	if packet.Header.Flags.SYN || utils.SeqGEQ(timestamp.Val, clientCtx.TsRecent) && utils.SeqLEQ(packet.Header.Seq, next) {
+		clientCtx.TsRecent = timestamp.Val
+	}
+	return true
+}
+
+// checks if the flags are as expected, false if no or timeout when receiving
+func hasReceivedPacket(clientCtx *ClientCtx, flags utils.Flags, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	packet, ok := readPacket(clientCtx, deadline)
+	if !ok {
+		return false
 	}
 
-	clientCtx.packetsReceived = append(clientCtx.packetsReceived, packet)
 	lastPacketSent := clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
 
 	if packet.Header.Flags.ACK && (!packet.Header.Flags.FIN || packet.Header.Flags.SYN) {
-		return flagsMatch(flags, packet.Header.Flags) && packet.Header.Ack > lastPacketSent.Header.Seq
+		return flagsMatch(flags, packet.Header.Flags) && utils.SeqGT(packet.Header.Ack, lastPacketSent.Header.Seq)
 	}
 	return flagsMatch(flags, packet.Header.Flags)
 }
 
+// runs an event through the connection's state machine, an event the current
+// state does not allow is printed and false is returned so it can be ignored
+func step(clientCtx *ClientCtx, event string) bool {
+	if err := utils.Step(clientCtx.FSM, event); err != nil {
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
+
+// runs an event the client causes itself, a send or a timer running out. if
+// the state machine refuses it the client has lost track of the connection, so
+// it is aborted rather than putting a packet on the wire it shouldn't
+func mustStep(clientCtx *ClientCtx, event string) {
+	if step(clientCtx, event) {
+		return
+	}
+
+	if len(clientCtx.packetsSent) > 0 {
+		sendReset(clientCtx, utils.RESET_PROTOCOL_VIOLATION)
+	}
+	step(clientCtx, EVENT_ABORT)
+	fmt.Println("Connection failed: client is in the wrong state to", event)
+	discardReply(clientCtx)
+	if clientCtx.Socket != nil {
+		clientCtx.Socket.Close()
+	}
+	fmt.Println("Exiting...")
+	os.Exit(EXIT_BAD_STATE)
+}
+
 func exit(clientCtx *ClientCtx) {
 	fmt.Println("Exiting...")
 	os.Exit(0)
 }
 
 func cleanup(clientCtx *ClientCtx) {
+	discardReply(clientCtx)
 	if clientCtx.Socket != nil {
 		clientCtx.Socket.Close()
 	}
@@ -162,34 +413,308 @@ func correctAck(clientCtx *ClientCtx) bool {
 	lastPacketReceieved := clientCtx.packetsReceived[len(clientCtx.packetsReceived)-1]
 	lastPacketSent := clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
 
-	return lastPacketReceieved.Header.Ack > lastPacketSent.Header.Seq
+	return utils.SeqGT(lastPacketReceieved.Header.Ack, lastPacketSent.Header.Seq)
+}
+
+// waits for an ack until the oldest segment in flight times out, false on timeout
+func receiveAck(clientCtx *ClientCtx, sentAt time.Time) (utils.Packet, bool) {
+	deadline := sentAt.Add(clientCtx.RTO.RTO)
+
+	return readPacket(clientCtx, deadline)
 }
 
 func send(clientCtx *ClientCtx) {
-	ackFlag := utils.Flags{ACK: true}
+	lastPacketReceived := clientCtx.packetsReceived[len(clientCtx.packetsReceived)-1]
+	lastPacketSent := clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
 
-	chunkSize := 512
+	window := utils.NewSendWindow(buildPackets(clientCtx, lastPacketReceived.Header.Ack, lastPacketSent.Header.Ack), clientCtx.WindowSize)
+	window.Advertise(lastPacketReceived.Header.Ack, clientCtx.PeerWindow)
+	clientCtx.LastAck = lastPacketReceived.Header.Ack
 
-	for i := 0; i < len(clientCtx.Data); i += chunkSize {
-		chunkEnd := math.Min(float64(len(clientCtx.Data)), float64(i+chunkSize))
-		chunk := clientCtx.Data[i:int(chunkEnd)]
+	persist := clientCtx.RTO.RTO
+
+	for !window.Done() {
+		updateWindow(clientCtx, window)
+		for window.CanSend() {
+			segment := window.Take()
+			sendSegment(clientCtx, segment)
+			fmt.Println("Sent -> PSH/ACK:", packetString(segment.Packet))
+		}
 
-		sendDataPacket(clientCtx, chunk)
-		lastPacketSent := clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
-		fmt.Println("Sent -> PSH/ACK:", packetString(lastPacketSent))
+		if window.Closed() {
+			packet, ok := readPacket(clientCtx, time.Now().Add(persist))
+			if !ok {
+				mustStep(clientCtx, EVENT_ACK_TIMEOUT)
+				retry(clientCtx)
+				sendWindowProbe(clientCtx, window)
+				persist = min(2*persist, utils.MAX_RTO)
+				continue
+			}
+			persist = clientCtx.RTO.RTO
+			processAck(clientCtx, window, packet)
+			continue
+		}
 
-		for !hasReceivedPacket(clientCtx, ackFlag) {
+		oldest := window.Oldest()
+		packet, ok := receiveAck(clientCtx, oldest.SentAt)
+		if !ok {
 			fmt.Println("Timeout waiting for ACK")
-			sendLastPacket(clientCtx)
+			mustStep(clientCtx, EVENT_ACK_TIMEOUT)
+			backoff(clientCtx)
+			clientCtx.Congestion.OnLoss(true)
+			oldest.Retransmitted = true
+			sendSegment(clientCtx, oldest)
+			fmt.Println("Sent -> REPEAT PSH/ACK:", packetString(oldest.Packet))
+			continue
+		}
+
+		processAck(clientCtx, window, packet)
+	}
+}
+
+// an ack with no data for the next unsent byte, the server answers it with
+// its current window so a lost window update cannot stall the transfer
+func sendWindowProbe(clientCtx *ClientCtx, window *utils.SendWindow) {
+	next := window.Segments[window.Next].Packet
+	sendPacket(clientCtx, utils.Flags{ACK: true}, "", next.Header.Seq, next.Header.Ack)
+
+	lastPacketSent := clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
+	fmt.Println("Sent -> WINDOW PROBE:", packetString(lastPacketSent))
+}
+
+func processAck(clientCtx *ClientCtx, window *utils.SendWindow, packet utils.Packet) {
+	if packet.Header.Flags.SYN {
+		// a late copy of the syn/ack, it was acked already
+		step(clientCtx, EVENT_RECEIVE_SYN_ACK)
+		return
+	} else if packet.Header.Flags.FIN {
+		step(clientCtx, EVENT_RECEIVE_FIN)
+		return
+	} else if !packet.Header.Flags.ACK || !step(clientCtx, EVENT_RECEIVE_ACK) {
+		return
+	}
+
+	duplicate := packet.Header.Ack == clientCtx.LastAck && window.InFlight() > 0
+
+	acked := window.Ack(packet.Header.Ack)
+	window.Sack(packet.Header.Sack)
+	window.Advertise(packet.Header.Ack, packet.Header.Window)
+	fmt.Printf("Received -> ACK: %s%s (%d acked, %d in flight, window %d)\n", packetString(packet), sackString(packet), len(acked), window.InFlight(), packet.Header.Window)
+
+	if utils.SeqGT(packet.Header.Ack, clientCtx.LastAck) {
+		clientCtx.LastAck = packet.Header.Ack
+	}
+
+	if len(acked) > 0 {
+		clientCtx.DupAcks = 0
+
+		newest := acked[len(acked)-1]
+		sampleRtt(clientCtx, packet, newest.SentAt, ambiguousAck(acked))
+		clientCtx.Congestion.OnAck(len(acked))
 
-			lastPacketSent = clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
-			fmt.Println("Sent -> REPEAT PSH/ACK:", packetString(lastPacketSent))
+		if clientCtx.InRecovery && utils.SeqGEQ(packet.Header.Ack, clientCtx.RecoverSeq) {
+			clientCtx.InRecovery = false
+			clientCtx.Congestion.OnRecovered()
+		} else if clientCtx.InRecovery {
+			// a partial ack means the segment after it was lost as well
+			retransmit(clientCtx, window.Oldest(), "PARTIAL ACK")
 		}
-		lastPacketReceieved := clientCtx.packetsReceived[len(clientCtx.packetsReceived)-1]
-		fmt.Println("Received -> ACK:", packetString(lastPacketReceieved))
+	} else if duplicate {
+		clientCtx.DupAcks++
+
+		if clientCtx.InRecovery {
+			clientCtx.Congestion.OnDupAck()
+		} else if clientCtx.DupAcks >= clientCtx.DupAckThreshold {
+			enterRecovery(clientCtx, window)
+			retransmit(clientCtx, window.Oldest(), "FAST")
+		}
+	}
+
+	// only resend what the sack blocks show is missing, once per hole
+	for _, segment := range window.Missing() {
+		if !clientCtx.InRecovery {
+			enterRecovery(clientCtx, window)
+		}
+		retransmit(clientCtx, segment, "SACK")
+	}
+}
+
+// shrinks the congestion window once for everything sent before the loss was
+// found, acks up to the recover point do not shrink it again
+func enterRecovery(clientCtx *ClientCtx, window *utils.SendWindow) {
+	last := window.Segments[window.Next-1].Packet
+	clientCtx.InRecovery = true
+	clientCtx.RecoverSeq = last.Header.Seq + last.Header.Len
+	clientCtx.Congestion.OnLoss(false)
+	fmt.Printf("Fast recovery until %d (%d duplicate ACKs)\n", clientCtx.RecoverSeq, clientCtx.DupAcks)
+}
+
+// resends a segment found lost from the acks, a segment that was already
+// resent is left to the retransmission timer
+func retransmit(clientCtx *ClientCtx, segment *utils.Segment, reason string) {
+	if segment == nil || segment.Retransmitted {
+		return
+	}
+
+	segment.Retransmitted = true
+	sendSegment(clientCtx, segment)
+	fmt.Printf("Sent -> %s REPEAT PSH/ACK: %s\n", reason, packetString(segment.Packet))
+}
+
+// the sender is limited by both the configured window and the congestion window
+func updateWindow(clientCtx *ClientCtx, window *utils.SendWindow) {
+	cwnd := clientCtx.Congestion.Window()
+	if cwnd != clientCtx.Cwnd {
+		fmt.Println("Congestion window:", cwnd)
+		clientCtx.Cwnd = cwnd
+	}
+
+	window.Size = max(1, min(clientCtx.WindowSize, cwnd))
+}
+
+// karn's rule, without timestamps only segments that were sent once give a
+// usable rtt
+func sampleRtt(clientCtx *ClientCtx, packet utils.Packet, sentAt time.Time, retransmitted bool) {
+	rtt := time.Since(sentAt)
+
+	// the echoed timestamp says which send the ack is for, so even acks for
+	// retransmissions can be sampled
+	timestamp, ok := packet.Header.Timestamp()
+	if echoed, valid := utils.TimestampRTT(timestamp.Ecr); ok && valid && clientCtx.Options[utils.OPTION_TIMESTAMP] {
+		rtt = echoed
+	} else if retransmitted {
+		return
+	}
+
+	rto := clientCtx.RTO.RTO
+	clientCtx.RTO.Sample(rtt)
+	if clientCtx.RTO.RTO != rto {
+		fmt.Println(clientCtx.RTO)
 	}
 }
 
+// an ack that fills a hole covers segments that were resent or were sacked
+// long before, the time since they were sent is not a round trip
+func ambiguousAck(acked []*utils.Segment) bool {
+	for _, segment := range acked {
+		if segment.Retransmitted || segment.Sacked {
+			return true
+		}
+	}
+	return false
+}
+
+func backoff(clientCtx *ClientCtx) {
+	retry(clientCtx)
+	clientCtx.RTO.Backoff()
+	fmt.Println(clientCtx.RTO)
+}
+
+// counts a timeout against the retry budget, once it is spent the server is
+// taken to be gone rather than retransmitting forever
+func retry(clientCtx *ClientCtx) {
+	clientCtx.Retries++
+	if clientCtx.Retries <= clientCtx.MaxRetries {
+		return
+	}
+
+	sendReset(clientCtx, utils.RESET_TIMEOUT)
+	peerDead(clientCtx, fmt.Errorf("%w after %d retries", utils.ErrPeerDead, clientCtx.MaxRetries))
+}
+
+// tells the server to drop the connection, in case it is still there. the
+// reset carries the sequence number after everything sent so it lands in the
+// server's window even when the last packet sent was a retransmission
+func sendReset(clientCtx *ClientCtx, reason utils.ResetReason) {
+	lastPacketSent := clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
+	seq := clientCtx.ISN
+	for _, sent := range clientCtx.packetsSent {
+		if end := sent.Header.Seq + sent.Header.Len; utils.SeqGT(end, seq) {
+			seq = end
+		}
+	}
+
+	packet := utils.Packet{
+		SrcAddr: clientCtx.Address,
+		DstAddr: clientCtx.Socket.LocalAddr().String(),
+		Header:  utils.Header{Flags: utils.Flags{RST: true}, Seq: seq, Ack: lastPacketSent.Header.Ack},
+	}
+	packet.Header.SetResetReason(reason)
+
+	bytes, err := utils.EncodePacket(packet)
+	if err == nil {
+		clientCtx.Socket.Write(bytes)
+	}
+	fmt.Printf("Sent -> RST (%s): %s\n", reason, packetString(packet))
+}
+
+// whether the server's syn/ack has been taken, PeerNext means nothing before
+// then. zero is as good an initial sequence number as any other
+func connected(clientCtx *ClientCtx) bool {
+	switch clientCtx.FSM.Current() {
+	case utils.ESTABLISHED, utils.FIN_WAIT, utils.TIME_WAIT:
+		return true
+	}
+	return false
+}
+
+// a reset has to answer the syn while it is unanswered and land in the
+// receive window after that, anything else could be a stray or forged one
+func acceptableReset(clientCtx *ClientCtx, packet utils.Packet) bool {
+	if clientCtx.FSM.Current() == utils.SYN_SENT {
+		return packet.Header.Ack == clientCtx.ISN+1
+	}
+
+	next := clientCtx.PeerNext
+	if clientCtx.Reply != nil {
+		next = clientCtx.Reply.Next
+	}
+	return utils.SeqInWindow(packet.Header.Seq, next, advertisedWindow(clientCtx))
+}
+
+// the server's syn/ack leaves too little room in a datagram for data, which
+// is rather given up on than sent a few bytes at a time
+func refuseLimits(clientCtx *ClientCtx, err error) {
+	sendReset(clientCtx, utils.RESET_POLICY_REJECTED)
+	step(clientCtx, EVENT_ABORT)
+	fmt.Println("Connection failed:", err)
+	discardReply(clientCtx)
+	clientCtx.Socket.Close()
+	fmt.Println("Exiting...")
+	os.Exit(EXIT_BAD_LIMITS)
+}
+
+// the server aborted the connection, there is nothing left to retry
+func reset(clientCtx *ClientCtx, packet utils.Packet) {
+	step(clientCtx, EVENT_ABORT)
+	fmt.Printf("Connection failed: %v (%s)\n", utils.ErrReset, packet.Header.ResetReason())
+	discardReply(clientCtx)
+	clientCtx.Socket.Close()
+	fmt.Println("Exiting...")
+	os.Exit(EXIT_RESET)
+}
+
+func peerDead(clientCtx *ClientCtx, err error) {
+	step(clientCtx, EVENT_ABORT)
+	fmt.Println("Connection failed:", err)
+	discardReply(clientCtx)
+	if clientCtx.Socket != nil {
+		clientCtx.Socket.Close()
+	}
+	fmt.Println("Exiting...")
+	os.Exit(EXIT_PEER_DEAD)
+}
+
+// the socket is connected, so a server that is gone can show up as an icmp
+// port unreachable on the next read or write
+func socketError(clientCtx *ClientCtx, err error) {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		peerDead(clientCtx, fmt.Errorf("%w: %v", utils.ErrPeerDead, err))
+	}
+	fmt.Println(err)
+	cleanup(clientCtx)
+}
+
 func readFile(clientCtx *ClientCtx) {
 	content, err := os.ReadFile(clientCtx.FilePath)
 	if err != nil {
@@ -217,54 +742,230 @@ func bindSocket(clientCtx *ClientCtx) {
 	fmt.Printf("The UDP server is %s\n", clientCtx.Socket.RemoteAddr().String())
 }
 
+// closes the client's side, the server acks the fin on its own when it has a
+// reply to send and closes its side once that is done, or acks it together
+// with its own fin when it has nothing to send
 func terminateConnection(clientCtx *ClientCtx) {
+	clientCtx.Reply = utils.NewReceiveBuffer(clientCtx.PeerNext)
+	openReply(clientCtx)
+
+	mustStep(clientCtx, EVENT_SEND_FIN)
 	sendFinPacket(clientCtx)
-	lastPacketSent := clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
-	fmt.Println("Sent -> FIN:", packetString(lastPacketSent))
+	fin := clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
+	clientCtx.SendNext = fin.Header.Seq + fin.Header.Len
+	fmt.Println("Sent -> FIN:", packetString(fin))
+
+	sentAt := time.Now()
+	retransmitted := false
+	acked, closed := false, false
+
+	for !acked {
+		packet, ok := readPacket(clientCtx, sentAt.Add(clientCtx.RTO.RTO))
+		if !ok {
+			fmt.Println("Timeout waiting for FIN to be acknowledged")
+			mustStep(clientCtx, EVENT_FIN_TIMEOUT)
+			backoff(clientCtx)
+			retransmitted = true
+			sendLastPacket(clientCtx)
+			sentAt = time.Now()
+			fmt.Println("Sent -> REPEAT FIN:", packetString(fin))
+			continue
+		}
 
-	finAckFlags := utils.Flags{FIN: true, ACK: true}
-	for !hasReceivedPacket(clientCtx, finAckFlags) {
-		fmt.Println("Timeout waiting for FIN/ACK")
-		sendLastPacket(clientCtx)
-		lastPacketSent = clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
-		fmt.Println("Sent -> REPEAT FIN:", packetString(lastPacketSent))
+		if packet.Header.Flags.ACK && utils.SeqGEQ(packet.Header.Ack, clientCtx.SendNext) {
+			acked = true
+			sampleRtt(clientCtx, packet, sentAt, retransmitted)
+		}
+		closed = receiveReply(clientCtx, packet) || closed
 	}
-	lastPacketReceieved := clientCtx.packetsReceived[len(clientCtx.packetsReceived)-1]
-	fmt.Println("Received -> FIN/ACK:", packetString(lastPacketReceieved))
 
-	sendAckPacket(clientCtx)
-	lastPacketSent = clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
-	fmt.Println("Sent -> ACK:", packetString(lastPacketSent))
+	if !closed {
+		fmt.Println("FIN acknowledged, waiting for the server to close")
+	}
+	for !closed {
+		packet, ok := readPacket(clientCtx, time.Now().Add(utils.KEEPALIVE_IDLE))
+		if !ok {
+			fmt.Println("Timeout waiting for the server to close")
+			mustStep(clientCtx, EVENT_FIN_TIMEOUT)
+			retry(clientCtx)
+			// our last ack may have been lost, so tell the server where we are
+			sendReplyAck(clientCtx)
+			continue
+		}
+		closed = receiveReply(clientCtx, packet)
+	}
+	commitReply(clientCtx)
+
+	// if server sends fin again, they did not get the final ack. the fsm's
+	// timer takes the connection out of TIME_WAIT, each repeated fin starts it
+	// over
+	for clientCtx.FSM.Current() == utils.TIME_WAIT {
+		packet, ok := readPacket(clientCtx, time.Now().Add(time.Duration(CLIENT_DELAY_SECONDS)*time.Second))
+		if !ok {
+			continue
+		}
+		if packet.Header.Flags.FIN {
+			fmt.Println("Received -> REPEAT FIN:", packetString(packet))
+			if step(clientCtx, EVENT_RECEIVE_FIN) {
+				sendReplyAck(clientCtx)
+			}
+		} else {
+			// nothing but a repeated fin is expected here, the step fails and
+			// says so
+			step(clientCtx, EVENT_RECEIVE_REPLY)
+		}
+	}
+}
 
-	// if server sends fin/ack again, they did not get the final ack
-	for hasReceivedPacket(clientCtx, finAckFlags) {
-		sendLastPacket(clientCtx)
-		lastPacketSent = clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
-		fmt.Println("Sent -> REPEAT ACK:", packetString(lastPacketSent))
+// the connection's state machine, which cuts the linger short once time wait
+// runs out
+func buildFSM(clientCtx *ClientCtx) *fsm.FSM {
+	machine := fsm.Build(utils.CLOSED, transitions, nil)
+	machine.OnEnter(utils.CLOSED, func(_ context.Context, transition *fsm.Transition) error {
+		if transition.Name == EVENT_TIME_WAIT_TIMEOUT {
+			timeWaitOver(clientCtx, transition)
+		}
+		return nil
+	})
+	return machine
+}
+
+// the time wait timer goes off on its own goroutine while the client is
+// blocked reading, so the change is logged here and the read cut short
+func timeWaitOver(clientCtx *ClientCtx, transition *fsm.Transition) {
+	fmt.Printf("State: %s -> %s (%s)\n", transition.Source, transition.To, transition.Name)
+	clientCtx.Socket.SetReadDeadline(time.Now())
+}
+
+// buffers and acks data the server sends after the client's fin, true once
+// the server's fin arrives with nothing missing before it
+func receiveReply(clientCtx *ClientCtx, packet utils.Packet) bool {
+	flags := packet.Header.Flags
+
+	if flags.FIN && packet.Header.Seq == clientCtx.Reply.Next {
+		if !step(clientCtx, EVENT_RECEIVE_FIN) {
+			return false
+		}
+		fmt.Println("Received -> FIN:", packetString(packet))
+		clientCtx.Reply.Next += packet.Header.Len
+		sendReplyAck(clientCtx)
+		return true
+	} else if !step(clientCtx, EVENT_RECEIVE_REPLY) {
+		return false
 	}
+
+	if flags.PSH && len(packet.Data) > 0 {
+		fmt.Println("Received -> PSH/ACK:", packetString(packet))
+		if !clientCtx.Reply.Insert(packet.Header.Seq, packet.Data) {
+			fmt.Println("Duplicate segment discarded:", packetString(packet))
+		}
+		deliverReply(clientCtx)
+		sendReplyAck(clientCtx)
+		return false
+	}
+
+	if !flags.FIN {
+		return false
+	}
+
+	fmt.Println("FIN before the end of the reply, waiting for the rest:", packetString(packet))
+	sendReplyAck(clientCtx)
+	return false
+}
+
+// acks everything the server sent so far, the seq is the one after the fin
+func sendReplyAck(clientCtx *ClientCtx) {
+	packet := buildPacket(clientCtx, utils.Flags{ACK: true}, "", clientCtx.SendNext, clientCtx.Reply.Next)
+	copy(packet.Header.Sack[:], clientCtx.Reply.SackBlocks(utils.MAX_SACK_BLOCKS))
+	writePacket(clientCtx, packet)
+	fmt.Printf("Sent -> ACK: %s%s\n", packetString(packet), sackString(packet))
+}
+
+func openReply(clientCtx *ClientCtx) {
+	if clientCtx.ReplyPath == "" {
+		return
+	}
+
+	output, err := utils.CreateOutputFile(filepath.Dir(clientCtx.ReplyPath), filepath.Base(clientCtx.ReplyPath), utils.OVERWRITE)
+	if err != nil {
+		fmt.Println(err)
+		cleanup(clientCtx)
+	}
+	clientCtx.ReplyOutput = output
+}
+
+func deliverReply(clientCtx *ClientCtx) {
+	data := clientCtx.Reply.Read()
+	if len(data) == 0 {
+		return
+	}
+
+	if clientCtx.ReplyOutput != nil {
+		if err := clientCtx.ReplyOutput.Write([]byte(data)); err != nil {
+			fmt.Println(err)
+			cleanup(clientCtx)
+		}
+	}
+	clientCtx.ReplyBytes += len(data)
+}
+
+func discardReply(clientCtx *ClientCtx) {
+	if clientCtx.ReplyOutput != nil {
+		clientCtx.ReplyOutput.Discard()
+		clientCtx.ReplyOutput = nil
+	}
+}
+
+func commitReply(clientCtx *ClientCtx) {
+	if clientCtx.ReplyOutput == nil {
+		if clientCtx.ReplyBytes > 0 {
+			fmt.Printf("Received a %d byte reply\n", clientCtx.ReplyBytes)
+		}
+		return
+	}
+
+	path, err := clientCtx.ReplyOutput.Commit()
+	if err != nil {
+		fmt.Println("Reply not saved:", err)
+	} else {
+		fmt.Printf("Saved %d byte reply to %s\n", clientCtx.ReplyBytes, path)
+	}
+	clientCtx.ReplyOutput = nil
 }
 
 func establishConnection(clientCtx *ClientCtx) {
+	mustStep(clientCtx, EVENT_SEND_SYN)
 	sendSynPacket(clientCtx)
 	lastPacketSent := clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
 	fmt.Println("Sent -> SYN:", packetString(lastPacketSent))
 
+	sentAt := time.Now()
+	retransmitted := false
+
 	synAckFlags := utils.Flags{SYN: true, ACK: true}
-	for !hasReceivedPacket(clientCtx, synAckFlags) {
+	for !hasReceivedPacket(clientCtx, synAckFlags, clientCtx.RTO.RTO) {
 		fmt.Println("Timeout waiting for SYN/ACK")
+		mustStep(clientCtx, EVENT_SYN_TIMEOUT)
+		backoff(clientCtx)
+		retransmitted = true
 		sendLastPacket(clientCtx)
 		lastPacketSent = clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
 		fmt.Println("Sent -> REPEAT SYN:", packetString(lastPacketSent))
 	}
 	lastPacketReceieved := clientCtx.packetsReceived[len(clientCtx.packetsReceived)-1]
 	fmt.Println("Received -> SYN/ACK:", packetString(lastPacketReceieved), lastPacketReceieved.Header.Len)
+	sampleRtt(clientCtx, lastPacketReceieved, sentAt, retransmitted)
+	mustStep(clientCtx, EVENT_RECEIVE_SYN_ACK)
 
 	sendAckPacket(clientCtx)
 	lastPacketSent = clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
 	fmt.Println("Sent -> ACK:", packetString(lastPacketSent))
 
 	// if server sends syn/ack again, they did not get the final ack
-	for hasReceivedPacket(clientCtx, synAckFlags) {
+	for hasReceivedPacket(clientCtx, synAckFlags, time.Duration(CLIENT_DELAY_SECONDS)*time.Second) {
+		if !step(clientCtx, EVENT_RECEIVE_SYN_ACK) {
+			continue
+		}
 		sendLastPacket(clientCtx)
 		lastPacketSent = clientCtx.packetsSent[len(clientCtx.packetsSent)-1]
 		fmt.Println("Sent -> REPEAT ACK:", packetString(lastPacketSent))
@@ -281,22 +982,130 @@ func checkArgs(clientCtx *ClientCtx) {
 	clientCtx.Address = address
 }
 
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Client sends a file to the server\n\n")
+
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n\n")
+
+	fmt.Fprintf(flag.CommandLine.Output(), "  go run client/client.go [flags] <ip> <port> <file>\n\n")
+
+	fmt.Fprintf(flag.CommandLine.Output(), "Arguments:\n\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  ip\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "\tip address of the server or proxy\n")
+
+	fmt.Fprintf(flag.CommandLine.Output(), "  port\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "\tport of the server or proxy\n")
+
+	fmt.Fprintf(flag.CommandLine.Output(), "  file\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "\tpath of the file to send\n")
+
+	fmt.Fprintf(flag.CommandLine.Output(), "Flags:\n\n")
+	flag.PrintDefaults()
+}
+
+func checkFlags(clientCtx *ClientCtx) {
+	if clientCtx.WindowSize < 1 {
+		fmt.Fprintln(flag.CommandLine.Output(), "-window must be at least 1")
+		usage()
+		exit(clientCtx)
+	}
+
+	if clientCtx.MaxRetries < 0 {
+		fmt.Fprintln(flag.CommandLine.Output(), "-retries must not be negative")
+		usage()
+		exit(clientCtx)
+	}
+
+	if clientCtx.DupAckThreshold < 1 {
+		fmt.Fprintln(flag.CommandLine.Output(), "-dupthresh must be at least 1")
+		usage()
+		exit(clientCtx)
+	}
+}
+
 func parseArgs(clientCtx *ClientCtx) {
-	arguments := os.Args
-	if len(arguments) < 4 {
-		fmt.Println("Not enough arguments")
+	windowSize := flag.Int("window", DEFAULT_WINDOW_SIZE, "max number of segments in flight")
+	codec := flag.String("codec", string(utils.BINARY), "packet encoding (binary, gob)")
+	congestion := flag.String("cc", "reno", "congestion control (reno, cubic, fixed)")
+	isn := flag.Int64("isn", -1, "initial sequence number, random when negative")
+	dupThreshold := flag.Int("dupthresh", DEFAULT_DUP_ACK_THRESHOLD, "duplicate ACKs before a fast retransmit")
+	mss := flag.Int("mss", utils.DEFAULT_MSS, "largest segment payload to send or accept, in bytes")
+	datagram := flag.Int("datagram", 0, "largest datagram to accept, in bytes, 0 fits the mss")
+	retries := flag.Int("retries", DEFAULT_RETRIES, "timeouts in a row before the server is taken to be gone")
+	replyPath := flag.String("out", "", "file to write the server's reply to, the reply is discarded when empty")
+	diagrams := flag.String("diagrams", "", "write the connection state diagrams to this directory and exit")
+
+	flag.CommandLine.Usage = usage
+	flag.Parse()
+
+	if *diagrams != "" {
+		if err := utils.WriteDiagrams(clientCtx.FSM, *diagrams, "client"); err != nil {
+			fmt.Println("Couldn't write the state diagrams:", err)
+		}
+		exit(clientCtx)
+	}
+
+	if len(flag.Args()) < 3 {
+		fmt.Fprintln(flag.CommandLine.Output(), "Not enough arguments")
+		usage()
+		exit(clientCtx)
+	}
+
+	clientCtx.Ip = flag.Args()[0]
+	clientCtx.Port = flag.Args()[1]
+	clientCtx.FilePath = flag.Args()[2]
+
+	clientCtx.WindowSize = *windowSize
+	clientCtx.DupAckThreshold = *dupThreshold
+	clientCtx.MaxRetries = *retries
+	clientCtx.ReplyPath = *replyPath
+
+	if *isn > math.MaxUint32 {
+		fmt.Fprintln(flag.CommandLine.Output(), "-isn must fit in 32 bits")
+		usage()
 		exit(clientCtx)
+	} else if *isn < 0 {
+		clientCtx.ISN = utils.RandomISN()
+	} else {
+		clientCtx.ISN = uint32(*isn)
 	}
 
-	clientCtx.Ip = os.Args[1]
-	clientCtx.Port = os.Args[2]
-	clientCtx.FilePath = os.Args[3]
+	if err := utils.SetCodec(*codec); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		usage()
+		exit(clientCtx)
+	}
 
+	limits, err := utils.NewLimits(*mss, *datagram)
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		usage()
+		exit(clientCtx)
+	}
+	clientCtx.Limits = limits
+	clientCtx.Negotiated = limits
+
+	controller, err := utils.NewCongestionController(*congestion, clientCtx.WindowSize)
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		usage()
+		exit(clientCtx)
+	}
+	clientCtx.Congestion = controller
+
+	checkFlags(clientCtx)
 	checkArgs(clientCtx)
 }
 
 func main() {
-	clientCtx := ClientCtx{}
+	if err := fsm.Validate(utils.CLOSED, transitions, nil); err != nil {
+		fmt.Println(err)
+		fmt.Println("Exiting...")
+		os.Exit(EXIT_INVALID_FSM)
+	}
+
+	clientCtx := ClientCtx{RTO: utils.NewRTOEstimator(), ReceiveWindow: DEFAULT_RECEIVE_WINDOW}
+	clientCtx.FSM = buildFSM(&clientCtx)
 	parseArgs(&clientCtx)
 	bindSocket(&clientCtx)
 	readFile(&clientCtx)
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// the diagrams in the repo have to match the transitions, go generate ./client
+// redraws them
+func TestDiagramsAreUpToDate(t *testing.T) {
+	machine := buildFSM(&ClientCtx{})
+
+	var dot, mermaid bytes.Buffer
+	if err := machine.Dot(&dot, "client"); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Mermaid(&mermaid); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, got := range map[string][]byte{"../diagrams/client.gv": dot.Bytes(), "../diagrams/client.mmd": mermaid.Bytes()} {
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s is out of date, run go generate ./client:\n%s", path, got)
+		}
+	}
+}
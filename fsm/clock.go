@@ -0,0 +1,101 @@
+package fsm
+
+import (
+	"sync"
+	"time"
+)
+
+// where the fsm gets its timers from, so timed transitions can be driven by
+// something other than the wall clock
+type Clock interface {
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Timer interface {
+	// returns false when the timer had already fired or been stopped
+	Stop() bool
+}
+
+// the default clock, timers go off in their own goroutine
+type SystemClock struct{}
+
+func (SystemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// a clock that only moves when Advance is called. timers that come due go off
+// in the goroutine calling Advance, earliest first
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+type manualTimer struct {
+	clock *ManualClock
+	due   time.Time
+	f     func()
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (clock *ManualClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+func (clock *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	timer := &manualTimer{clock: clock, due: clock.now.Add(d), f: f}
+	clock.timers = append(clock.timers, timer)
+	return timer
+}
+
+// moves the clock forward by d, firing every timer that comes due on the way,
+// including ones set by the timers that fire
+func (clock *ManualClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	until := clock.now.Add(d)
+
+	for {
+		next := -1
+		for i, timer := range clock.timers {
+			if !timer.due.After(until) && (next < 0 || timer.due.Before(clock.timers[next].due)) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+
+		timer := clock.timers[next]
+		clock.timers = append(clock.timers[:next], clock.timers[next+1:]...)
+		clock.now = timer.due
+
+		clock.mu.Unlock()
+		timer.f()
+		clock.mu.Lock()
+	}
+
+	clock.now = until
+	clock.mu.Unlock()
+}
+
+func (timer *manualTimer) Stop() bool {
+	clock := timer.clock
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	for i, pending := range clock.timers {
+		if pending == timer {
+			clock.timers = append(clock.timers[:i], clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package fsm
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+const TEST_TIMEOUT = 3 * time.Second
+
+// WAIT gives up and goes to CLOSED after TEST_TIMEOUT unless it is left for
+// IDLE or looped on with "retry" first
+func timedMachine(clock Clock) *FSM {
+	machine := Build("IDLE", []Transitions{
+		{Name: "wait", From: []string{"IDLE"}, To: "WAIT"},
+		{Name: "retry", From: []string{"WAIT"}, To: "WAIT"},
+		{Name: "answer", From: []string{"WAIT"}, To: "IDLE"},
+		{Name: "give up", From: []string{"WAIT"}, To: "CLOSED", Timeout: TEST_TIMEOUT},
+	}, nil)
+	machine.SetClock(clock)
+	return machine
+}
+
+func transition(t *testing.T, machine *FSM, name string) {
+	t.Helper()
+	if err := machine.Transition(context.Background(), name); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+}
+
+func wantState(t *testing.T, machine *FSM, want string) {
+	t.Helper()
+	if got := machine.Current(); got != want {
+		t.Fatalf("state is %s, want %s", got, want)
+	}
+}
+
+func TestTimedTransitionFiresAtTimeout(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	machine := timedMachine(clock)
+	transition(t, machine, "wait")
+
+	clock.Advance(TEST_TIMEOUT - time.Nanosecond)
+	wantState(t, machine, "WAIT")
+
+	clock.Advance(time.Nanosecond)
+	wantState(t, machine, "CLOSED")
+}
+
+func TestLeavingStateCancelsTimer(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	machine := timedMachine(clock)
+	transition(t, machine, "wait")
+
+	clock.Advance(TEST_TIMEOUT / 2)
+	transition(t, machine, "answer")
+	clock.Advance(TEST_TIMEOUT)
+	wantState(t, machine, "IDLE")
+
+	// coming back starts the full timeout over
+	transition(t, machine, "wait")
+	clock.Advance(TEST_TIMEOUT - time.Nanosecond)
+	wantState(t, machine, "WAIT")
+	clock.Advance(time.Nanosecond)
+	wantState(t, machine, "CLOSED")
+}
+
+func TestSelfLoopRearmsTimer(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	machine := timedMachine(clock)
+	transition(t, machine, "wait")
+
+	clock.Advance(TEST_TIMEOUT - time.Second)
+	transition(t, machine, "retry")
+
+	clock.Advance(TEST_TIMEOUT - time.Nanosecond)
+	wantState(t, machine, "WAIT")
+	clock.Advance(time.Nanosecond)
+	wantState(t, machine, "CLOSED")
+}
+
+func TestSetClockMovesRunningTimers(t *testing.T) {
+	first := NewManualClock(time.Unix(0, 0))
+	machine := timedMachine(first)
+	transition(t, machine, "wait")
+
+	second := NewManualClock(time.Unix(0, 0))
+	machine.SetClock(second)
+
+	first.Advance(2 * TEST_TIMEOUT)
+	wantState(t, machine, "WAIT")
+
+	second.Advance(TEST_TIMEOUT)
+	wantState(t, machine, "CLOSED")
+}
@@ -0,0 +1,175 @@
+package fsm
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// every state the machine knows about, the initial state first and then in
+// the order the transitions and hooks mention them. "*" is left out since
+// it stands for all of them
+func (fsm *FSM) states() []string {
+	states := []string{}
+	add := func(state string) {
+		if state != "*" && !slices.Contains(states, state) {
+			states = append(states, state)
+		}
+	}
+
+	add(fsm.initial)
+	for _, name := range fsm.names {
+		transition := fsm.transitions[name]
+		for _, from := range transition.From {
+			add(from)
+		}
+		add(transition.To)
+	}
+
+	withHooks := []string{}
+	for state := range fsm.onEnter {
+		withHooks = append(withHooks, state)
+	}
+	for state := range fsm.onExit {
+		withHooks = append(withHooks, state)
+	}
+	sort.Strings(withHooks)
+	for _, state := range withHooks {
+		add(state)
+	}
+
+	add(fsm.Current())
+	return states
+}
+
+func (fsm *FSM) hasHooks(state string) bool {
+	return len(fsm.onEnter[state]) > 0 || len(fsm.onExit[state]) > 0
+}
+
+// a timed transition's label says how long it waits
+func (fsm *FSM) label(name string) string {
+	if timeout := fsm.transitions[name].Timeout; timeout > 0 {
+		return fmt.Sprintf("%s (after %s)", name, timeout)
+	}
+	return name
+}
+
+func (fsm *FSM) hasWildcard() bool {
+	for _, transition := range fsm.transitions {
+		if slices.Contains(transition.From, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// writes the machine as a graphviz digraph. the current state is filled in,
+// states with enter or exit hooks are drawn bold and transitions from "*" come
+// out of a separate "any state" node as dashed edges
+func (fsm *FSM) Dot(w io.Writer, name string) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "digraph %q {\n", name)
+	b.WriteString("  node [shape = circle; fontsize = 15; width = 1; height = 1;];\n")
+	b.WriteString("  edge [fontsize = 15;];\n\n")
+
+	current := fsm.Current()
+	b.WriteString("  // States\n")
+	b.WriteString("  \"\" [shape = point; width = 0.2; height = 0.2;];\n")
+	for _, state := range fsm.states() {
+		attributes := []string{}
+		styles := []string{}
+		if fsm.hasHooks(state) {
+			styles = append(styles, "bold")
+		}
+		if state == current {
+			styles = append(styles, "filled")
+			attributes = append(attributes, "fillcolor = lightblue;")
+		}
+		if len(styles) > 0 {
+			attributes = append([]string{fmt.Sprintf("style = %q;", strings.Join(styles, ","))}, attributes...)
+		}
+
+		if len(attributes) == 0 {
+			fmt.Fprintf(&b, "  %q;\n", state)
+		} else {
+			fmt.Fprintf(&b, "  %q [%s];\n", state, strings.Join(attributes, " "))
+		}
+	}
+	if fsm.hasWildcard() {
+		b.WriteString("  \"*\" [shape = plaintext; label = \"any state\";];\n")
+	}
+
+	b.WriteString("\n  // Transitions\n")
+	fmt.Fprintf(&b, "  \"\" -> %q;\n", fsm.initial)
+	for _, name := range fsm.names {
+		transition := fsm.transitions[name]
+		for _, from := range transition.From {
+			if from == "*" {
+				fmt.Fprintf(&b, "  \"*\" -> %q [label = %q; style = dashed;];\n", transition.To, fsm.label(name))
+			} else {
+				fmt.Fprintf(&b, "  %q -> %q [label = %q;];\n", from, transition.To, fsm.label(name))
+			}
+		}
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// mermaid state ids can only be made of letters, digits and underscores, so
+// anything else is swapped out and the real name given as the state's label
+func mermaidId(state string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, state)
+}
+
+// writes the machine as a mermaid stateDiagram, highlighted the same way as
+// the dot output. transitions from "*" come out of an "any state" state
+func (fsm *FSM) Mermaid(w io.Writer) error {
+	var b strings.Builder
+	states := fsm.states()
+	current := fsm.Current()
+
+	b.WriteString("stateDiagram-v2\n")
+	for _, state := range states {
+		if id := mermaidId(state); id != state {
+			fmt.Fprintf(&b, "    state %q as %s\n", state, id)
+		}
+	}
+	if fsm.hasWildcard() {
+		b.WriteString("    state \"any state\" as ANY_STATE\n")
+	}
+
+	fmt.Fprintf(&b, "    [*] --> %s\n", mermaidId(fsm.initial))
+	for _, name := range fsm.names {
+		transition := fsm.transitions[name]
+		label := strings.ReplaceAll(fsm.label(name), ":", "#colon;")
+		for _, from := range transition.From {
+			id := "ANY_STATE"
+			if from != "*" {
+				id = mermaidId(from)
+			}
+			fmt.Fprintf(&b, "    %s --> %s: %s\n", id, mermaidId(transition.To), label)
+		}
+	}
+
+	b.WriteString("    classDef current fill:lightblue\n")
+	b.WriteString("    classDef hooks stroke-width:3px\n")
+	for _, state := range states {
+		if fsm.hasHooks(state) {
+			fmt.Fprintf(&b, "    class %s hooks\n", mermaidId(state))
+		}
+	}
+	fmt.Fprintf(&b, "    class %s current\n", mermaidId(current))
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -2,67 +2,256 @@ package fsm
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"slices"
+	"sync"
+	"time"
 )
 
+// what a callback is told about the transition it is running for. Source is
+// the state being left, it stays the current state until the exit hooks have
+// run
 type Transition struct {
-	Fsm  *FSM
-	To   string
-	From []string
+	Fsm    *FSM
+	Name   string
+	Source string
+	To     string
+	From   []string
 }
 
+// Guard can reject the transition before anything runs, Before and After run
+// around the state hooks. any of them returning an error stops the transition.
+// a transition with a Timeout fires on its own once the machine has been in
+// one of its From states for that long
 type Transitions struct {
 	Name, To string
 	From     []string
+	Guard    Callback
+	Before   Callback
+	After    Callback
+	Timeout  time.Duration
 }
 
 type (
-	Callback func(context.Context, *Transition)
-	Actions  struct {
+	Callback func(context.Context, *Transition) error
+	// an action runs every time its state is entered, same as OnEnter
+	Actions struct {
 		Callback Callback
 		To       string
 	}
 )
 
 type FSM struct {
-	transitions map[string]Transition
-	actions     map[string]Callback
-	state       string
+	transitions map[string]Transitions
+	onEnter     map[string][]Callback
+	onExit      map[string][]Callback
+	// transition names in the order they were built, so exports come out the
+	// same every time
+	names   []string
+	initial string
+
+	// transitioning keeps two transitions from running at once and covers the
+	// timers. mu only covers the fields below it so Current can be called from
+	// inside a hook
+	transitioning sync.Mutex
+	clock         Clock
+	timers        []Timer
+	// bumped every time a state is entered so a timer that went off just as
+	// its state was left knows not to fire
+	entered uint64
+	mu      sync.Mutex
+	state   string
+	loopCtx context.Context
+	pending []event
+	wake    chan struct{}
 }
 
 func Build(initial string, transitions []Transitions, actions []Actions) *FSM {
-	fsm := FSM{state: initial, transitions: make(map[string]Transition), actions: make(map[string]Callback)}
+	fsm := FSM{
+		state:       initial,
+		initial:     initial,
+		transitions: make(map[string]Transitions),
+		onEnter:     make(map[string][]Callback),
+		onExit:      make(map[string][]Callback),
+		clock:       SystemClock{},
+	}
 
 	for _, transition := range transitions {
-		fsm.transitions[transition.Name] = Transition{Fsm: &fsm, To: transition.To, From: transition.From}
+		if _, ok := fsm.transitions[transition.Name]; !ok {
+			fsm.names = append(fsm.names, transition.Name)
+		}
+		fsm.transitions[transition.Name] = transition
 	}
 
 	for _, action := range actions {
-		fsm.actions[action.To] = action.Callback
+		fsm.OnEnter(action.To, action.Callback)
 	}
 
+	// the timers can go off before Build returns
+	fsm.transitioning.Lock()
+	fsm.arm(initial)
+	fsm.transitioning.Unlock()
+
 	return &fsm
 }
 
+// swaps the clock timed transitions run on. the timers of the current state are
+// started over on the new clock
+func (fsm *FSM) SetClock(clock Clock) {
+	fsm.transitioning.Lock()
+	defer fsm.transitioning.Unlock()
+
+	fsm.clock = clock
+	fsm.arm(fsm.Current())
+}
+
+// stops the timers of the state being left and starts the ones of the state
+// just entered. transitioning has to be held
+func (fsm *FSM) arm(state string) {
+	for _, timer := range fsm.timers {
+		timer.Stop()
+	}
+	fsm.timers = nil
+	fsm.entered++
+	entered := fsm.entered
+
+	for _, name := range fsm.names {
+		definition := fsm.transitions[name]
+		if definition.Timeout <= 0 || !allows(definition, state) {
+			continue
+		}
+
+		name := name
+		fsm.timers = append(fsm.timers, fsm.clock.AfterFunc(definition.Timeout, func() {
+			fsm.fire(entered, name)
+		}))
+	}
+}
+
+// runs a timed transition. there's no one to hand the error to, a timed
+// transition that fails just leaves the machine where it was
+func (fsm *FSM) fire(entered uint64, name string) {
+	fsm.transitioning.Lock()
+	defer fsm.transitioning.Unlock()
+
+	if fsm.entered != entered {
+		return
+	}
+	fsm.transition(context.Background(), name)
+}
+
+func allows(definition Transitions, state string) bool {
+	return slices.Contains(definition.From, "*") || slices.Contains(definition.From, state)
+}
+
+// adds a hook that runs after the state is entered, self loops included.
+// hooks run in the order they were added. hooks are meant to be added while
+// setting the machine up, not while it is running transitions
+func (fsm *FSM) OnEnter(state string, callback Callback) {
+	fsm.onEnter[state] = append(fsm.onEnter[state], callback)
+}
+
+// adds a hook that runs before the state is left, self loops included
+func (fsm *FSM) OnExit(state string, callback Callback) {
+	fsm.onExit[state] = append(fsm.onExit[state], callback)
+}
+
 func (fsm *FSM) Current() string {
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
 	return fsm.state
 }
 
+func (fsm *FSM) setState(state string) {
+	fsm.mu.Lock()
+	fsm.state = state
+	fsm.mu.Unlock()
+}
+
+// returned when a hook calls Transition or Send on the machine it is running
+// for, the call would otherwise wait on itself forever
+var ErrReentrant = errors.New("fsm is already running a transition")
+
+// marks the contexts hooks are given with the machine running them
+type transitionKey struct{}
+
+// runs the named transition. the order is guard, before, exit hooks of the
+// current state, the state change, enter hooks of the new state and then after.
+// a guard that fails rejects the transition before any hook runs. any other
+// hook that fails stops the rest and puts the machine back in the state it
+// started in, without running that state's enter hooks again. what the hooks
+// that already ran did, exit and enter hooks included, is not undone. the
+// timers of the state started in were never stopped and go off when they would
+// have. transitions are run one at a time, a hook calling Transition or Send
+// with the ctx it was given gets ErrReentrant. Post can be used to run one once
+// the current transition is done
 func (fsm *FSM) Transition(ctx context.Context, name string) error {
-	transition, ok := fsm.transitions[name]
+	if ctx.Value(transitionKey{}) == fsm {
+		return fmt.Errorf("transition %s: %w", name, ErrReentrant)
+	}
+	return fsm.lockedTransition(ctx, name)
+}
+
+func (fsm *FSM) lockedTransition(ctx context.Context, name string) error {
+	fsm.transitioning.Lock()
+	defer fsm.transitioning.Unlock()
+
+	return fsm.transition(ctx, name)
+}
+
+func (fsm *FSM) transition(ctx context.Context, name string) error {
+	definition, ok := fsm.transitions[name]
 	if !ok {
 		return fmt.Errorf("transition with name: %s not found", name)
 	}
+	ctx = context.WithValue(ctx, transitionKey{}, fsm)
+
+	source := fsm.Current()
+	if !allows(definition, source) {
+		return fmt.Errorf("cannot transition from %s to %s", source, definition.To)
+	}
+
+	transition := Transition{Fsm: fsm, Name: name, Source: source, To: definition.To, From: definition.From}
 
-	if !slices.Contains(transition.From, "*") && !slices.Contains(transition.From, fsm.state) {
-		return fmt.Errorf("cannot transition from %s to %s", fsm.state, transition.To)
+	if definition.Guard != nil {
+		if err := definition.Guard(ctx, &transition); err != nil {
+			return fmt.Errorf("transition %s rejected by guard: %w", name, err)
+		}
 	}
 
-	fsm.state = transition.To
-	if action, ok := fsm.actions[transition.To]; ok {
-		action(ctx, &transition)
+	if err := run(ctx, &transition, "before", definition.Before); err != nil {
+		return err
 	}
 
+	if err := run(ctx, &transition, "exit "+transition.Source, fsm.onExit[transition.Source]...); err != nil {
+		return err
+	}
+
+	fsm.setState(transition.To)
+
+	if err := run(ctx, &transition, "enter "+transition.To, fsm.onEnter[transition.To]...); err != nil {
+		fsm.setState(transition.Source)
+		return err
+	}
+
+	if err := run(ctx, &transition, "after", definition.After); err != nil {
+		fsm.setState(transition.Source)
+		return err
+	}
+
+	fsm.arm(transition.To)
+	return nil
+}
+
+func run(ctx context.Context, transition *Transition, hook string, callbacks ...Callback) error {
+	for _, callback := range callbacks {
+		if callback == nil {
+			continue
+		}
+		if err := callback(ctx, transition); err != nil {
+			return fmt.Errorf("%s hook of transition %s failed: %w", hook, transition.Name, err)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,173 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// a machine whose enter hook on B calls back into it with the function given
+func reentrantMachine(call func(context.Context, *FSM) error) *FSM {
+	machine := Build("A", []Transitions{
+		{Name: "go", From: []string{"A"}, To: "B"},
+		{Name: "back", From: []string{"B"}, To: "A"},
+	}, nil)
+	machine.OnEnter("B", func(ctx context.Context, transition *Transition) error {
+		return call(ctx, transition.Fsm)
+	})
+	return machine
+}
+
+// fails the test instead of hanging it if a nested call deadlocks
+func transitionWithin(t *testing.T, machine *FSM, name string) error {
+	t.Helper()
+	result := make(chan error, 1)
+	go func() {
+		result <- machine.Transition(context.Background(), name)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s deadlocked", name)
+		return nil
+	}
+}
+
+func TestNestedTransitionFails(t *testing.T) {
+	var nested error
+	machine := reentrantMachine(func(ctx context.Context, machine *FSM) error {
+		nested = machine.Transition(ctx, "back")
+		return nil
+	})
+
+	if err := transitionWithin(t, machine, "go"); err != nil {
+		t.Fatalf("go: %v", err)
+	}
+	if !errors.Is(nested, ErrReentrant) {
+		t.Fatalf("nested transition returned %v, want %v", nested, ErrReentrant)
+	}
+	wantState(t, machine, "B")
+}
+
+func TestNestedSendFails(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var nested error
+	machine := reentrantMachine(func(hookCtx context.Context, machine *FSM) error {
+		nested = machine.Send(hookCtx, "back")
+		return nil
+	})
+	machine.Start(ctx)
+
+	if err := transitionWithin(t, machine, "go"); err != nil {
+		t.Fatalf("go: %v", err)
+	}
+	if !errors.Is(nested, ErrReentrant) {
+		t.Fatalf("nested send returned %v, want %v", nested, ErrReentrant)
+	}
+}
+
+func TestPostFromHookRunsAfter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var posted <-chan error
+	machine := reentrantMachine(func(hookCtx context.Context, machine *FSM) error {
+		posted = machine.Post(hookCtx, "back")
+		return nil
+	})
+	machine.Start(ctx)
+
+	if err := transitionWithin(t, machine, "go"); err != nil {
+		t.Fatalf("go: %v", err)
+	}
+	if err := <-posted; err != nil {
+		t.Fatalf("posted back: %v", err)
+	}
+	wantState(t, machine, "A")
+}
+
+var errHook = errors.New("hook failed")
+
+// "answer" takes WAIT back to IDLE through every kind of hook, each one records
+// itself and the one named by fail returns errHook while running "answer". WAIT
+// gives up on its own after TEST_TIMEOUT
+func hookedMachine(clock Clock, fail string) (*FSM, *[]string) {
+	calls := []string{}
+	hook := func(name string) Callback {
+		return func(_ context.Context, transition *Transition) error {
+			calls = append(calls, name)
+			if name == fail && transition.Name == "answer" {
+				return errHook
+			}
+			return nil
+		}
+	}
+
+	machine := Build("IDLE", []Transitions{
+		{Name: "wait", From: []string{"IDLE"}, To: "WAIT"},
+		{Name: "answer", From: []string{"WAIT"}, To: "IDLE", Guard: hook("guard"), Before: hook("before"), After: hook("after")},
+		{Name: "give up", From: []string{"WAIT"}, To: "CLOSED", Timeout: TEST_TIMEOUT},
+		{Name: "open", From: []string{"CLOSED"}, To: "IDLE"},
+	}, nil)
+	machine.OnExit("WAIT", hook("exit WAIT"))
+	machine.OnEnter("IDLE", hook("enter IDLE"))
+	machine.SetClock(clock)
+	return machine, &calls
+}
+
+func TestHooksRunInOrder(t *testing.T) {
+	machine, calls := hookedMachine(NewManualClock(time.Unix(0, 0)), "")
+	transition(t, machine, "wait")
+	transition(t, machine, "answer")
+
+	want := []string{"guard", "before", "exit WAIT", "enter IDLE", "after"}
+	if !slices.Equal(*calls, want) {
+		t.Fatalf("hooks ran as %v, want %v", *calls, want)
+	}
+	wantState(t, machine, "IDLE")
+}
+
+func TestGuardVetoRunsNoHooks(t *testing.T) {
+	machine, calls := hookedMachine(NewManualClock(time.Unix(0, 0)), "guard")
+	transition(t, machine, "wait")
+
+	if err := machine.Transition(context.Background(), "answer"); !errors.Is(err, errHook) {
+		t.Fatalf("answer returned %v, want %v", err, errHook)
+	}
+	if want := []string{"guard"}; !slices.Equal(*calls, want) {
+		t.Fatalf("hooks ran as %v, want %v", *calls, want)
+	}
+	wantState(t, machine, "WAIT")
+}
+
+func TestHookFailureRollsBack(t *testing.T) {
+	stages := []string{"before", "exit WAIT", "enter IDLE", "after"}
+
+	for i, stage := range stages {
+		t.Run(stage, func(t *testing.T) {
+			clock := NewManualClock(time.Unix(0, 0))
+			machine, calls := hookedMachine(clock, stage)
+			transition(t, machine, "wait")
+			clock.Advance(TEST_TIMEOUT / 2)
+
+			if err := machine.Transition(context.Background(), "answer"); !errors.Is(err, errHook) {
+				t.Fatalf("answer returned %v, want %v", err, errHook)
+			}
+			if want := append([]string{"guard"}, stages[:i+1]...); !slices.Equal(*calls, want) {
+				t.Fatalf("hooks ran as %v, want %v", *calls, want)
+			}
+			wantState(t, machine, "WAIT")
+
+			// WAIT was never left, so its timer still goes off when it would have
+			clock.Advance(TEST_TIMEOUT/2 - time.Nanosecond)
+			wantState(t, machine, "WAIT")
+			clock.Advance(time.Nanosecond)
+			wantState(t, machine, "CLOSED")
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// returned for events posted while the machine's event loop is not running,
+// including the ones still queued when it stops
+var ErrNotRunning = errors.New("fsm is not running")
+
+type event struct {
+	ctx    context.Context
+	name   string
+	result chan error
+}
+
+// starts a goroutine that runs posted events one at a time in the order they
+// were posted, until ctx is done. Transition can still be called directly
+// while it runs, the two take turns
+func (fsm *FSM) Start(ctx context.Context) {
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+
+	if fsm.runningLocked() {
+		return
+	}
+	// a loop that is still winding down keeps its own wake channel so it
+	// can't take wake ups meant for this one
+	fsm.loopCtx = ctx
+	fsm.wake = make(chan struct{}, 1)
+	if len(fsm.pending) > 0 {
+		fsm.wake <- struct{}{}
+	}
+	go fsm.loop(ctx, fsm.wake)
+}
+
+// mu has to be held
+func (fsm *FSM) runningLocked() bool {
+	return fsm.loopCtx != nil && fsm.loopCtx.Err() == nil
+}
+
+func (fsm *FSM) loop(ctx context.Context, wake chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			fsm.stop(ctx)
+			return
+		case <-wake:
+		}
+
+		for ctx.Err() == nil {
+			fsm.mu.Lock()
+			if len(fsm.pending) == 0 {
+				fsm.mu.Unlock()
+				break
+			}
+			next := fsm.pending[0]
+			fsm.pending[0] = event{}
+			fsm.pending = fsm.pending[1:]
+			fsm.mu.Unlock()
+
+			// an event whose caller gave up while it was queued is not run
+			if err := next.ctx.Err(); err != nil {
+				next.result <- err
+			} else {
+				// posted from a hook is fine, the hook is done by now
+				next.result <- fsm.lockedTransition(next.ctx, next.name)
+			}
+		}
+	}
+}
+
+// fails whatever is still queued so no one is left waiting on it
+func (fsm *FSM) stop(ctx context.Context) {
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+
+	if fsm.loopCtx != ctx {
+		// Start has already handed the queue to a new loop
+		return
+	}
+	for _, pending := range fsm.pending {
+		pending.result <- ErrNotRunning
+	}
+	fsm.pending = nil
+}
+
+// queues the named transition and returns straight away. the channel gets the
+// transition's result once the event loop has run it, ctx's error if ctx is
+// done before then, or ErrNotRunning
+func (fsm *FSM) Post(ctx context.Context, name string) <-chan error {
+	result := make(chan error, 1)
+
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+
+	if !fsm.runningLocked() {
+		result <- ErrNotRunning
+		return result
+	}
+
+	fsm.pending = append(fsm.pending, event{ctx: ctx, name: name, result: result})
+	select {
+	case fsm.wake <- struct{}{}:
+	default:
+	}
+	return result
+}
+
+// posts the named transition and waits for its result or for ctx to be done
+func (fsm *FSM) Send(ctx context.Context, name string) error {
+	if ctx.Value(transitionKey{}) == fsm {
+		return fmt.Errorf("send %s: %w", name, ErrReentrant)
+	}
+	select {
+	case err := <-fsm.Post(ctx, name):
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
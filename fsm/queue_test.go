@@ -0,0 +1,212 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+type orderKey struct{}
+
+// a machine that records the order value of every transition it runs. "block"
+// holds the event loop until release is closed, so tests can queue events
+// behind it
+func orderedMachine(release chan struct{}, started chan struct{}) (*FSM, func() []int) {
+	var mu sync.Mutex
+	var order []int
+
+	machine := Build("IDLE", []Transitions{
+		{Name: "next", From: []string{"*"}, To: "IDLE"},
+		{Name: "block", From: []string{"*"}, To: "IDLE", Before: func(context.Context, *Transition) error {
+			close(started)
+			<-release
+			return nil
+		}},
+	}, nil)
+	machine.OnEnter("IDLE", func(ctx context.Context, transition *Transition) error {
+		if i, ok := ctx.Value(orderKey{}).(int); ok {
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		}
+		return nil
+	})
+
+	return machine, func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int(nil), order...)
+	}
+}
+
+func TestQueueRunsEventsInOrder(t *testing.T) {
+	machine, order := orderedMachine(nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	machine.Start(ctx)
+
+	results := make([]<-chan error, 500)
+	for i := range results {
+		results[i] = machine.Post(context.WithValue(context.Background(), orderKey{}, i), "next")
+	}
+	for i, result := range results {
+		if err := <-result; err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+	}
+
+	got := order()
+	if len(got) != len(results) {
+		t.Fatalf("ran %d events, want %d", len(got), len(results))
+	}
+	for i, value := range got {
+		if value != i {
+			t.Fatalf("event %d ran in position %d", value, i)
+		}
+	}
+}
+
+func TestQueueSkipsEventsCancelledWhileQueued(t *testing.T) {
+	release, started := make(chan struct{}), make(chan struct{})
+	machine, order := orderedMachine(release, started)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	machine.Start(ctx)
+
+	blocked := machine.Post(context.Background(), "block")
+	<-started
+
+	eventCtx, cancelEvent := context.WithCancel(context.WithValue(context.Background(), orderKey{}, 1))
+	cancelled := machine.Post(eventCtx, "next")
+	after := machine.Post(context.WithValue(context.Background(), orderKey{}, 2), "next")
+	cancelEvent()
+	close(release)
+
+	if err := <-blocked; err != nil {
+		t.Fatalf("block: %v", err)
+	}
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled event returned %v, want %v", err, context.Canceled)
+	}
+	if err := <-after; err != nil {
+		t.Fatalf("event after the cancelled one: %v", err)
+	}
+	if got := order(); len(got) != 1 || got[0] != 2 {
+		t.Fatalf("ran %v, want only [2]", got)
+	}
+}
+
+func TestQueueFailsEventsOnceStopped(t *testing.T) {
+	release, started := make(chan struct{}), make(chan struct{})
+	machine, order := orderedMachine(release, started)
+
+	if err := <-machine.Post(context.Background(), "next"); !errors.Is(err, ErrNotRunning) {
+		t.Fatalf("post before Start returned %v, want %v", err, ErrNotRunning)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	machine.Start(ctx)
+
+	blocked := machine.Post(context.Background(), "block")
+	<-started
+
+	queued := make([]<-chan error, 10)
+	for i := range queued {
+		queued[i] = machine.Post(context.WithValue(context.Background(), orderKey{}, i), "next")
+	}
+	cancel()
+	close(release)
+
+	if err := <-blocked; err != nil {
+		t.Fatalf("block: %v", err)
+	}
+	for i, result := range queued {
+		if err := <-result; !errors.Is(err, ErrNotRunning) {
+			t.Errorf("queued event %d returned %v, want %v", i, err, ErrNotRunning)
+		}
+	}
+	if err := <-machine.Post(context.Background(), "next"); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("post after stopping returned %v, want %v", err, ErrNotRunning)
+	}
+	if err := machine.Send(context.Background(), "next"); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("send after stopping returned %v, want %v", err, ErrNotRunning)
+	}
+	if got := order(); len(got) != 0 {
+		t.Errorf("ran %v after stopping, want nothing", got)
+	}
+}
+
+// meant for go test -race: posts, direct transitions, timers and exports all
+// at once, each poster's events still have to run in the order it posted them
+func TestQueueUnderConcurrentPosting(t *testing.T) {
+	const posters, events = 50, 200
+
+	var mu sync.Mutex
+	seen := make(map[int][]int)
+
+	machine := Build("IDLE", []Transitions{
+		{Name: "next", From: []string{"*"}, To: "IDLE"},
+		{Name: "busy", From: []string{"IDLE"}, To: "BUSY"},
+		{Name: "done", From: []string{"BUSY"}, To: "IDLE", Timeout: time.Millisecond},
+	}, nil)
+	machine.OnEnter("IDLE", func(ctx context.Context, transition *Transition) error {
+		if value, ok := ctx.Value(orderKey{}).([2]int); ok {
+			mu.Lock()
+			seen[value[0]] = append(seen[value[0]], value[1])
+			mu.Unlock()
+		}
+		return nil
+	})
+	clock := NewManualClock(time.Unix(0, 0))
+	machine.SetClock(clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	machine.Start(ctx)
+
+	var wg sync.WaitGroup
+	for poster := 0; poster < posters; poster++ {
+		wg.Add(1)
+		go func(poster int) {
+			defer wg.Done()
+
+			results := make([]<-chan error, events)
+			for i := range results {
+				results[i] = machine.Post(context.WithValue(context.Background(), orderKey{}, [2]int{poster, i}), "next")
+
+				switch i % 4 {
+				case 0:
+					// either state is fine, only the locking is under test
+					machine.Transition(context.Background(), "busy")
+				case 1:
+					clock.Advance(time.Millisecond)
+				case 2:
+					machine.Dot(io.Discard, "test")
+				case 3:
+					machine.Current()
+				}
+			}
+			for i, result := range results {
+				if err := <-result; err != nil {
+					t.Errorf("poster %d event %d: %v", poster, i, err)
+				}
+			}
+		}(poster)
+	}
+	wg.Wait()
+
+	for poster := 0; poster < posters; poster++ {
+		got := seen[poster]
+		if len(got) != events {
+			t.Fatalf("poster %d had %d events run, want %d", poster, len(got), events)
+		}
+		for i, value := range got {
+			if value != i {
+				t.Fatalf("poster %d event %d ran in position %d", poster, value, i)
+			}
+		}
+	}
+}
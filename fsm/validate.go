@@ -0,0 +1,137 @@
+package fsm
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// checks a definition before it is built, Build itself takes anything. every
+// problem found is reported:
+//   - transition names used more than once, Build would keep only the last
+//   - transitions with no From states, or with "*" next to named states
+//   - From states no transition leads to and that aren't the initial state
+//   - states, actions included, that can't be reached from the initial state
+//   - dead ends, reachable states the machine can never leave
+//   - timed transitions from the same state with the same timeout, only one of
+//     them could ever fire
+func Validate(initial string, transitions []Transitions, actions []Actions) error {
+	problems := []error{}
+	if initial == "" || initial == "*" {
+		problems = append(problems, fmt.Errorf("initial state %q is not a state", initial))
+	}
+
+	seen := map[string]bool{}
+	destinations := map[string]bool{initial: true}
+	for _, transition := range transitions {
+		if seen[transition.Name] {
+			problems = append(problems, fmt.Errorf("transition %s is defined more than once", transition.Name))
+		}
+		seen[transition.Name] = true
+		destinations[transition.To] = true
+
+		if transition.To == "" || transition.To == "*" {
+			problems = append(problems, fmt.Errorf("transition %s goes to %q, which is not a state", transition.Name, transition.To))
+		}
+		if len(transition.From) == 0 {
+			problems = append(problems, fmt.Errorf("transition %s has no From states", transition.Name))
+		} else if slices.Contains(transition.From, "*") && len(transition.From) > 1 {
+			problems = append(problems, fmt.Errorf("transition %s lists states next to \"*\"", transition.Name))
+		}
+	}
+
+	// states that show up only as a From can never be the current state
+	dangling := map[string]bool{}
+	for _, transition := range transitions {
+		for _, from := range transition.From {
+			if from != "*" && !destinations[from] && !dangling[from] {
+				dangling[from] = true
+				problems = append(problems, fmt.Errorf("transition %s starts from %s, which no transition leads to", transition.Name, from))
+			}
+		}
+	}
+
+	// walk everything reachable from the initial state, "*" transitions are
+	// open to every state walked
+	reachable := map[string]bool{initial: true}
+	for queue := []string{initial}; len(queue) > 0; queue = queue[1:] {
+		for _, transition := range transitions {
+			if allows(transition, queue[0]) && !reachable[transition.To] {
+				reachable[transition.To] = true
+				queue = append(queue, transition.To)
+			}
+		}
+	}
+
+	states := []string{initial}
+	for _, transition := range transitions {
+		states = append(states, transition.To)
+	}
+	for _, action := range actions {
+		states = append(states, action.To)
+	}
+
+	reported := map[string]bool{}
+	for _, state := range states {
+		if reported[state] || state == "" || state == "*" {
+			continue
+		}
+		reported[state] = true
+
+		if !reachable[state] {
+			problems = append(problems, fmt.Errorf("state %s can't be reached from %s", state, initial))
+			continue
+		}
+
+		exit := slices.ContainsFunc(transitions, func(transition Transitions) bool {
+			return transition.To != state && allows(transition, state)
+		})
+		if !exit {
+			problems = append(problems, fmt.Errorf("state %s is a dead end, no transition leaves it", state))
+		}
+	}
+
+	for i, transition := range transitions {
+		if transition.Timeout <= 0 {
+			continue
+		}
+		for _, other := range transitions[i+1:] {
+			if other.Timeout != transition.Timeout {
+				continue
+			}
+			if shared := sharedState(transition, other); shared != "" {
+				problems = append(problems, fmt.Errorf("timed transitions %s and %s both fire from %s after %s", transition.Name, other.Name, shared, transition.Timeout))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid fsm definition:\n%w", errors.Join(problems...))
+	}
+	return nil
+}
+
+// a From state the two transitions have in common, empty when there is none
+func sharedState(a Transitions, b Transitions) string {
+	if slices.Contains(a.From, "*") {
+		if len(b.From) > 0 {
+			return b.From[0]
+		}
+		return ""
+	}
+	for _, from := range a.From {
+		if allows(b, from) {
+			return from
+		}
+	}
+	return ""
+}
+
+// same as Build but panics when Validate finds something wrong, for machines
+// defined in code that should stop the program at startup if they're broken
+func MustBuild(initial string, transitions []Transitions, actions []Actions) *FSM {
+	if err := Validate(initial, transitions, actions); err != nil {
+		panic(err)
+	}
+	return Build(initial, transitions, actions)
+}
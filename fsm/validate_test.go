@@ -0,0 +1,103 @@
+package fsm
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		transitions []Transitions
+		actions     []Actions
+		// empty when the definition is valid
+		want string
+	}{
+		{
+			name: "valid",
+			transitions: []Transitions{
+				{Name: "go", From: []string{"A"}, To: "B"},
+				{Name: "back", From: []string{"B"}, To: "A"},
+				{Name: "reset", From: []string{"*"}, To: "A"},
+			},
+		},
+		{
+			name: "duplicate name",
+			transitions: []Transitions{
+				{Name: "go", From: []string{"A"}, To: "B"},
+				{Name: "go", From: []string{"B"}, To: "A"},
+			},
+			want: "transition go is defined more than once",
+		},
+		{
+			name: "empty from",
+			transitions: []Transitions{
+				{Name: "go", From: []string{"A"}, To: "B"},
+				{Name: "back", To: "A"},
+				{Name: "reset", From: []string{"B"}, To: "A"},
+			},
+			want: "transition back has no From states",
+		},
+		{
+			name: "wildcard next to named states",
+			transitions: []Transitions{
+				{Name: "go", From: []string{"A"}, To: "B"},
+				{Name: "back", From: []string{"*", "B"}, To: "A"},
+			},
+			want: `transition back lists states next to "*"`,
+		},
+		{
+			name: "dangling from",
+			transitions: []Transitions{
+				{Name: "go", From: []string{"A"}, To: "B"},
+				{Name: "back", From: []string{"B", "C"}, To: "A"},
+			},
+			want: "transition back starts from C, which no transition leads to",
+		},
+		{
+			name: "unreachable state",
+			transitions: []Transitions{
+				{Name: "go", From: []string{"A"}, To: "B"},
+				{Name: "back", From: []string{"B"}, To: "A"},
+			},
+			actions: []Actions{{To: "C"}},
+			want:    "state C can't be reached from A",
+		},
+		{
+			name: "dead end",
+			transitions: []Transitions{
+				{Name: "go", From: []string{"A"}, To: "B"},
+				{Name: "stay", From: []string{"B"}, To: "B"},
+			},
+			want: "state B is a dead end, no transition leaves it",
+		},
+		{
+			name: "timed transitions sharing a timeout",
+			transitions: []Transitions{
+				{Name: "go", From: []string{"A"}, To: "B"},
+				{Name: "back", From: []string{"B"}, To: "A", Timeout: time.Second},
+				{Name: "reset", From: []string{"*"}, To: "A", Timeout: time.Second},
+			},
+			want: "timed transitions back and reset both fire from B after 1s",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validate("A", test.transitions, test.actions)
+			if test.want == "" {
+				if err != nil {
+					t.Fatalf("Validate returned %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate returned nil, want %q", test.want)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("Validate returned %q, want it to contain %q", err, test.want)
+			}
+		})
+	}
+}
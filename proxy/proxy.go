@@ -2,11 +2,13 @@ package main
 
 import (
 	"comp7005_project/utils"
+	"errors"
 	"flag"
 	"fmt"
 	"math/rand"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"gonum.org/v1/plot"
@@ -28,8 +30,19 @@ type ProxyCtx struct {
 	ClientDelayMin, ClientDelayMax       int
 	ServerDelayMin, ServerDelayMax       int
 
+	Corrupted int
+
 	ClientPackets []utils.PacketAndTime
 	ServerPackets []utils.PacketAndTime
+
+	// when each timestamp was first seen going through, so its echo coming
+	// back gives the round trip between the proxy and the other side. the
+	// delay goroutines record them too and the graph goroutine reads the
+	// samples, rttLock covers all four
+	rttLock                            sync.Mutex
+	clientTimestamps, serverTimestamps map[uint32]time.Time
+	ServerRTTs, ClientRTTs             []utils.RTTAndTime
+
 	initialPacket bool
 	initialTime   time.Time
 }
@@ -101,12 +114,76 @@ func generateGraph(proxyCtx *ProxyCtx) {
 		if err := p.Save(8*vg.Inch, 4*vg.Inch, "retransmissions.png"); err != nil {
 			panic(err)
 		}
+		generateRttGraph(proxyCtx)
 
 		time.Sleep(1 * time.Second)
 	}
 
 }
 
+// remembers the timestamp in a packet and records a round trip when the
+// packet echoes one that went the other way
+func recordTimestamp(proxyCtx *ProxyCtx, packet utils.Packet, fromServer bool) {
+	timestamp, ok := packet.Header.Timestamp()
+	if !ok {
+		return
+	}
+
+	proxyCtx.rttLock.Lock()
+	defer proxyCtx.rttLock.Unlock()
+
+	sent, echoed := proxyCtx.clientTimestamps, proxyCtx.serverTimestamps
+	if fromServer {
+		sent, echoed = proxyCtx.serverTimestamps, proxyCtx.clientTimestamps
+	}
+
+	if _, seen := sent[timestamp.Val]; !seen {
+		sent[timestamp.Val] = time.Now()
+	}
+
+	// only the first echo is a round trip, later ones just repeat it
+	if at, ok := echoed[timestamp.Ecr]; ok {
+		sample := utils.RTTAndTime{Time: time.Since(proxyCtx.initialTime).Seconds(), RTT: time.Since(at)}
+		if fromServer {
+			proxyCtx.ServerRTTs = append(proxyCtx.ServerRTTs, sample)
+		} else {
+			proxyCtx.ClientRTTs = append(proxyCtx.ClientRTTs, sample)
+		}
+		delete(echoed, timestamp.Ecr)
+	}
+}
+
+func rttPoints(samples []utils.RTTAndTime) plotter.XYs {
+	pts := make(plotter.XYs, len(samples))
+	for i, sample := range samples {
+		pts[i].X = sample.Time
+		pts[i].Y = float64(sample.RTT) / float64(time.Millisecond)
+	}
+
+	return pts
+}
+
+func generateRttGraph(proxyCtx *ProxyCtx) {
+	p := plot.New()
+	p.Title.Text = "Round Trip Times Through the Proxy"
+	p.X.Label.Text = "Time (seconds)"
+	p.Y.Label.Text = "RTT (milliseconds)"
+	p.Y.Min = 0
+
+	// the points are copied out so the lock isn't held while plotting
+	proxyCtx.rttLock.Lock()
+	serverPoints, clientPoints := rttPoints(proxyCtx.ServerRTTs), rttPoints(proxyCtx.ClientRTTs)
+	proxyCtx.rttLock.Unlock()
+
+	err := plotutil.AddScatters(p, "Proxy to server", serverPoints, "Proxy to client", clientPoints)
+	if err != nil {
+		panic(err)
+	}
+	if err := p.Save(8*vg.Inch, 4*vg.Inch, "rtt.png"); err != nil {
+		panic(err)
+	}
+}
+
 func packetString(packet utils.Packet) string {
 	return fmt.Sprintf("[Seq: %d | Ack: %d | Len: %d]", packet.Header.Seq, packet.Header.Ack, packet.Header.Len)
 }
@@ -139,7 +216,7 @@ func randRange(min int, max int) int {
 }
 
 func receive(proxyCtx *ProxyCtx) {
-	buffer := make([]byte, 1024)
+	buffer := make([]byte, utils.MAX_DATAGRAM_SIZE)
 	n, addr, err := proxyCtx.Socket.ReadFromUDP(buffer)
 	if err != nil {
 		fmt.Println(err)
@@ -148,10 +225,20 @@ func receive(proxyCtx *ProxyCtx) {
 
 	proxyCtx.ClientAddress = addr
 
-	packet, _ := utils.DecodePacket(proxyCtx.Data)
+	packet, err := utils.DecodePacket(proxyCtx.Data)
+	if errors.Is(err, utils.ErrCorrupt) {
+		proxyCtx.Corrupted++
+		fmt.Printf("Corrupt packet dropped from %s (%d so far)\n", addr, proxyCtx.Corrupted)
+		receive(proxyCtx)
+	}
+
+	if packet.Header.Flags.RST {
+		fmt.Printf("Connection reset by %s (%s): %s\n", addr, packet.Header.ResetReason(), packetString(packet))
+	}
 
 	if sendTo(addr.String(), proxyCtx.ServerAddress.String()) {
 		proxyCtx.ServerPackets = append(proxyCtx.ServerPackets, utils.PacketAndTime{Time: float64(time.Since(proxyCtx.initialTime).Seconds()), Packet: packet})
+		recordTimestamp(proxyCtx, packet, true)
 
 		dropChance := rand.Intn(100)
 
@@ -175,6 +262,7 @@ func receive(proxyCtx *ProxyCtx) {
 
 	} else {
 		proxyCtx.ClientPackets = append(proxyCtx.ClientPackets, utils.PacketAndTime{Time: time.Since(proxyCtx.initialTime).Seconds(), Packet: packet})
+		recordTimestamp(proxyCtx, packet, false)
 
 		dropChance := rand.Intn(100)
 
@@ -393,6 +481,8 @@ func main() {
 	proxyCtx := ProxyCtx{}
 	proxyCtx.initialPacket = true
 	proxyCtx.initialTime = time.Now()
+	proxyCtx.clientTimestamps = make(map[uint32]time.Time)
+	proxyCtx.serverTimestamps = make(map[uint32]time.Time)
 	go generateGraph(&proxyCtx)
 	parseArgs(&proxyCtx)
 }
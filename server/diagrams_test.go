@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// the diagrams in the repo have to match the transitions, go generate ./server
+// redraws them
+func TestDiagramsAreUpToDate(t *testing.T) {
+	machine := buildFSM(nil)
+
+	var dot, mermaid bytes.Buffer
+	if err := machine.Dot(&dot, "server"); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Mermaid(&mermaid); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, got := range map[string][]byte{"../diagrams/server.gv": dot.Bytes(), "../diagrams/server.mmd": mermaid.Bytes()} {
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s is out of date, run go generate ./server:\n%s", path, got)
+		}
+	}
+}
@@ -1,34 +1,142 @@
+//go:generate go run . -diagrams ../diagrams
+
 package main
 
 import (
+	"comp7005_project/fsm"
 	"comp7005_project/utils"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
 	"time"
 )
 
-const SERVER_DELAY_SECONDS int = 1
+const DEFAULT_RECEIVE_WINDOW int = 64 * 1024
 
-type ServerCtx struct {
-	Socket        *net.UDPConn
-	ClientAddress *net.UDPAddr
+// segments of the reply in flight at once, the client's window can shrink it
+const REPLY_WINDOW_SIZE int = 64
+
+// times a syn/ack, fin/ack or reply segment is resent before giving up
+const RESEND_LIMIT int = 7
+
+// exit code when the connection state machine fails validation at startup
+const EXIT_INVALID_FSM int = 1
+
+// everything that moves a connection between states, each one is a packet from
+// the client or a timer running out
+const (
+	EVENT_RECEIVE_SYN       = "receive syn"
+	EVENT_SYN_ACK_TIMEOUT   = "syn/ack timeout"
+	EVENT_RECEIVE_ACK       = "receive ack"
+	EVENT_RECEIVE_DATA      = "receive data"
+	EVENT_ACK_TIMEOUT       = "ack timeout"
+	EVENT_KEEPALIVE_TIMEOUT = "keepalive timeout"
+	EVENT_RECEIVE_FIN       = "receive fin"
+	EVENT_RECEIVE_REPLY_ACK = "receive reply ack"
+	EVENT_REPLY_TIMEOUT     = "reply timeout"
+	EVENT_SEND_FIN          = "send fin"
+	EVENT_FIN_TIMEOUT       = "fin timeout"
+	EVENT_RECEIVE_LAST_ACK  = "receive last ack"
+	EVENT_ABORT             = "abort"
+)
 
-	packetsSent, packetsReceived []utils.Packet
+// a connection starts CLOSED when the first packet from its address arrives
+// and is removed once it is CLOSED again
+var transitions = []fsm.Transitions{
+	{Name: EVENT_RECEIVE_SYN, From: []string{utils.CLOSED, utils.SYN_RCVD}, To: utils.SYN_RCVD},
+	{Name: EVENT_SYN_ACK_TIMEOUT, From: []string{utils.SYN_RCVD}, To: utils.SYN_RCVD},
+	{Name: EVENT_RECEIVE_ACK, From: []string{utils.SYN_RCVD, utils.ESTABLISHED}, To: utils.ESTABLISHED},
+	{Name: EVENT_RECEIVE_DATA, From: []string{utils.ESTABLISHED}, To: utils.ESTABLISHED},
+	{Name: EVENT_ACK_TIMEOUT, From: []string{utils.ESTABLISHED}, To: utils.ESTABLISHED},
+	{Name: EVENT_KEEPALIVE_TIMEOUT, From: []string{utils.ESTABLISHED}, To: utils.ESTABLISHED},
+	{Name: EVENT_RECEIVE_FIN, From: []string{utils.ESTABLISHED, utils.CLOSE_WAIT}, To: utils.CLOSE_WAIT},
+	{Name: EVENT_RECEIVE_REPLY_ACK, From: []string{utils.CLOSE_WAIT}, To: utils.CLOSE_WAIT},
+	{Name: EVENT_REPLY_TIMEOUT, From: []string{utils.CLOSE_WAIT}, To: utils.CLOSE_WAIT},
+	{Name: EVENT_SEND_FIN, From: []string{utils.CLOSE_WAIT}, To: utils.LAST_ACK},
+	{Name: EVENT_FIN_TIMEOUT, From: []string{utils.LAST_ACK}, To: utils.LAST_ACK},
+	{Name: EVENT_RECEIVE_LAST_ACK, From: []string{utils.LAST_ACK}, To: utils.CLOSED},
+	{Name: EVENT_ABORT, From: []string{"*"}, To: utils.CLOSED},
+}
 
+// state shared by every connection
+type Server struct {
+	Socket   *net.UDPConn
 	Ip, Port string
-	Packet   utils.Packet
 
-	Timeout bool
+	OutputDir, OutputName string
+	Collision             utils.CollisionPolicy
+
+	ReceiveWindow int
+
+	// sent back after the client closes its side, nothing when empty
+	ReplyPath string
+	Reply     string
+
+	// what this side accepts, each connection negotiates its own from it
+	Limits utils.Limits
 
-	EstablishCount   int
-	TerminationCount int
+	KeepaliveIdle, KeepaliveInterval time.Duration
+	KeepaliveCount                   int
+
+	Corrupted int
+
+	// one connection per client address, all served by the listen loop
+	connections map[string]*ServerCtx
 }
 
-const (
-	INPUT_ERROR = "Usage: <filename> <ip address> <port_number>"
-)
+// a single client's connection
+type ServerCtx struct {
+	*Server
+	ClientAddress *net.UDPAddr
+	FSM           *fsm.FSM
+
+	// only the last packet sent is kept, so a long transfer does not grow the
+	// connection
+	lastSent utils.Packet
+
+	Packet utils.Packet
+
+	ISN uint32
+	// the server's next sequence number, it only moves past isn + 1 when a
+	// reply is sent, and the ack that should answer the last syn/ack or fin
+	SendNext, ExpectedAck uint32
+
+	// the smaller of Limits and what the client sent in its syn
+	Negotiated utils.Limits
+	// options the client put in its syn that this side also supports
+	Options utils.OptionSet
+	// the timestamp echoed back to the client, only taken from segments that
+	// reach the left edge of the window so echoes are never too recent
+	TsRecent uint32
+
+	Buffer    *utils.ReceiveBuffer
+	Output    *utils.OutputFile
+	Delivered int
+
+	// the reply being sent after the client's fin, nil otherwise
+	ReplyWindow  *utils.SendWindow
+	ReplyFin     utils.Packet
+	ReplyRetries int
+	// when the connection's timeout handler runs, never when zero
+	Deadline time.Time
+
+	// an open connection the client has gone quiet on is probed every
+	// KeepaliveInterval after KeepaliveIdle, and dropped once KeepaliveCount
+	// probes go unanswered
+	LastHeard time.Time
+	Probes    int
+
+	RTO           *utils.RTOEstimator
+	SentAt        time.Time
+	Retransmitted bool
+	// times the syn/ack or fin/ack was resent
+	Resends int
+}
 
 func packetString(packet utils.Packet) string {
 	return fmt.Sprintf("[Seq: %d | Ack: %d]", packet.Header.Seq, packet.Header.Ack)
@@ -38,24 +146,168 @@ func random(min, max int) int {
 	return rand.Intn(max-min) + min
 }
 
-func exit(serverCtx *ServerCtx) {
+func exit(server *Server) {
 	fmt.Println("Exiting...")
 	os.Exit(0)
 }
 
 func cleanup(serverCtx *ServerCtx) {
-	if serverCtx.Socket != nil {
-		serverCtx.Socket.Close()
+	if serverCtx.Output != nil {
+		serverCtx.Output.Discard()
+	}
+	shutdown(serverCtx.Server)
+}
+
+func shutdown(server *Server) {
+	if server.Socket != nil {
+		server.Socket.Close()
+	}
+	exit(server)
+}
+
+// the only place the socket is read. each packet goes to the handler for the
+// state its connection is in, and the read deadline is the earliest timer of
+// any connection so expired timers are handled between packets
+func listen(server *Server) {
+	buffer := make([]byte, utils.MAX_DATAGRAM_SIZE)
+
+	for {
+		server.Socket.SetReadDeadline(nextDeadline(server))
+
+		n, addr, err := server.Socket.ReadFromUDP(buffer)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			expire(server)
+			continue
+		} else if err != nil {
+			fmt.Println(err)
+			shutdown(server)
+		}
+
+		packet, err := utils.DecodePacket(buffer[0:n])
+		if errors.Is(err, utils.ErrCorrupt) {
+			dropCorrupt(server)
+		} else if err != nil {
+			fmt.Println(err)
+		} else {
+			dispatch(server, addr, packet)
+		}
+
+		// a busy client must not keep the others' timers from firing
+		expire(server)
 	}
-	exit(serverCtx)
 }
 
+// every connection gets its own state machine, the output it was writing is
+// thrown away whenever it ends up CLOSED without having been committed
+func buildFSM(serverCtx *ServerCtx) *fsm.FSM {
+	return fsm.Build(utils.CLOSED, transitions, connectionActions(serverCtx))
+}
+
+func connectionActions(serverCtx *ServerCtx) []fsm.Actions {
+	return []fsm.Actions{
+		{To: utils.CLOSED, Callback: func(context.Context, *fsm.Transition) error {
+			discardOutput(serverCtx)
+			return nil
+		}},
+	}
+}
+
+// hands the packet to its connection, starting one for an address that has
+// none
+func dispatch(server *Server, addr *net.UDPAddr, packet utils.Packet) {
+	serverCtx, ok := server.connections[addr.String()]
+	if !ok {
+		serverCtx = &ServerCtx{
+			Server:        server,
+			ClientAddress: addr,
+			Negotiated:    server.Limits,
+			RTO:           utils.NewRTOEstimator(),
+		}
+		// anything a connection leaves unfinished is thrown away once it closes,
+		// a completed transfer has already been committed by then
+		serverCtx.FSM = buildFSM(serverCtx)
+		server.connections[addr.String()] = serverCtx
+		fmt.Printf("New connection from %s (%d open)\n", addr, len(server.connections))
+	}
+
+	switch serverCtx.FSM.Current() {
+	case utils.SYN_RCVD, utils.LAST_ACK:
+		receiveAck(serverCtx, packet)
+	case utils.CLOSE_WAIT:
+		receiveReplyAck(serverCtx, packet)
+	default:
+		receive(serverCtx, packet)
+	}
+	settle(serverCtx)
+}
+
+// runs the timeout handler of every connection whose deadline has passed
+func expire(server *Server) {
+	now := time.Now()
+
+	for _, serverCtx := range server.connections {
+		if serverCtx.Deadline.IsZero() || now.Before(serverCtx.Deadline) {
+			continue
+		}
+
+		switch serverCtx.FSM.Current() {
+		case utils.SYN_RCVD, utils.LAST_ACK:
+			ackTimeout(serverCtx)
+		case utils.CLOSE_WAIT:
+			replyTimeout(serverCtx)
+		case utils.ESTABLISHED:
+			receiveTimeout(serverCtx)
+		}
+		settle(serverCtx)
+	}
+}
+
+// arms the connection's timer after a handler ran, or removes the connection
+// once it is closed. the next packet from the address starts a new one
+func settle(serverCtx *ServerCtx) {
+	switch serverCtx.FSM.Current() {
+	case utils.CLOSED:
+		delete(serverCtx.connections, serverCtx.ClientAddress.String())
+		fmt.Printf("Connection from %s closed (%d open)\n", serverCtx.ClientAddress, len(serverCtx.connections))
+	case utils.SYN_RCVD, utils.LAST_ACK:
+		serverCtx.Deadline = serverCtx.SentAt.Add(serverCtx.RTO.RTO)
+	case utils.CLOSE_WAIT:
+		serverCtx.Deadline = time.Now().Add(serverCtx.RTO.RTO)
+		// with nothing in flight the oldest segment is one that was never sent
+		if window := serverCtx.ReplyWindow; window.InFlight() > 0 {
+			serverCtx.Deadline = window.Oldest().SentAt.Add(serverCtx.RTO.RTO)
+		}
+	default:
+		serverCtx.Deadline = readDeadline(serverCtx)
+	}
+}
+
+// the earliest timer of any connection, none when there are no connections
+func nextDeadline(server *Server) time.Time {
+	var deadline time.Time
+	for _, serverCtx := range server.connections {
+		if !serverCtx.Deadline.IsZero() && (deadline.IsZero() || serverCtx.Deadline.Before(deadline)) {
+			deadline = serverCtx.Deadline
+		}
+	}
+	return deadline
+}
+
+// closes the server's side, serverCtx.Packet is the client's fin
 func sendFinAck(serverCtx *ServerCtx) {
+	if err := utils.Step(serverCtx.FSM, EVENT_SEND_FIN); err != nil {
+		fmt.Println(err)
+		return
+	}
+	seq := serverCtx.SendNext
+
 	packet := utils.Packet{
 		SrcAddr: serverCtx.Packet.SrcAddr,
 		DstAddr: serverCtx.Packet.DstAddr,
-		Header:  utils.Header{Flags: utils.Flags{FIN: true, ACK: true}, Seq: serverCtx.Packet.Header.Ack, Ack: serverCtx.Packet.Header.Seq + serverCtx.Packet.Header.Len, Len: 0},
+		Header:  utils.Header{Flags: utils.Flags{FIN: true, ACK: true}, Seq: seq, Ack: serverCtx.Packet.Header.Seq + serverCtx.Packet.Header.Len, Len: 1, Window: advertisedWindow(serverCtx)},
 	}
+	stampPacket(serverCtx, &packet)
+	serverCtx.ExpectedAck = seq + 1
 
 	bytes, err := utils.EncodePacket(packet)
 	if err != nil {
@@ -69,26 +321,21 @@ func sendFinAck(serverCtx *ServerCtx) {
 		cleanup(serverCtx)
 	}
 
-	serverCtx.packetsSent = append(serverCtx.packetsSent, packet)
+	serverCtx.lastSent = packet
+	serverCtx.SentAt = time.Now()
+	serverCtx.Retransmitted = false
+	serverCtx.Resends = 0
 	fmt.Println("Send -> FIN/ACK with packet:", packetString(packet))
-
-	waitForAck(serverCtx)
 }
 
 func send(serverCtx *ServerCtx) {
-	lastPacketReceived := serverCtx.packetsReceived[len(serverCtx.packetsReceived)-1]
-	// lastPacketSent := serverCtx.packetsSent[len(serverCtx.packetsSent)-1]
-
 	packet := utils.Packet{
 		SrcAddr: serverCtx.Packet.SrcAddr,
 		DstAddr: serverCtx.Packet.DstAddr,
-		Header:  utils.Header{Flags: utils.Flags{ACK: true}, Seq: lastPacketReceived.Header.Ack, Ack: lastPacketReceived.Header.Seq + lastPacketReceived.Header.Len, Len: 1},
-	}
-
-	if lastPacketReceived.Header.Flags.SYN {
-		packet.Header.Ack = 1
-		packet.Header.Seq = 0
+		Header:  utils.Header{Flags: utils.Flags{ACK: true}, Seq: serverCtx.SendNext, Ack: serverCtx.Buffer.Next, Len: 1, Window: advertisedWindow(serverCtx)},
 	}
+	copy(packet.Header.Sack[:], serverCtx.Buffer.SackBlocks(utils.MAX_SACK_BLOCKS))
+	stampPacket(serverCtx, &packet)
 
 	bytes, err := utils.EncodePacket(packet)
 	if err != nil {
@@ -102,81 +349,550 @@ func send(serverCtx *ServerCtx) {
 		cleanup(serverCtx)
 	}
 
-	serverCtx.packetsSent = append(serverCtx.packetsSent, packet)
+	serverCtx.lastSent = packet
 	fmt.Println("\nSend -> ACK with packet:", packetString(packet))
+}
+
+// a packet for a connection that is CLOSED or ESTABLISHED
+func receive(serverCtx *ServerCtx, packet utils.Packet) {
+	flags := packet.Header.Flags
+
+	if flags.RST {
+		receiveReset(serverCtx, packet)
+		return
+	}
+
+	if flags.SYN && (flags.FIN || flags.PSH) {
+		fmt.Println("Received -> SYN with FIN or PSH set:", packetString(packet))
+		sendReset(serverCtx, packet, utils.RESET_PROTOCOL_VIOLATION)
+		return
+	}
 
-	receive(serverCtx)
+	if !flags.SYN && !checkTimestamp(serverCtx, packet) {
+		fmt.Println("Old duplicate rejected by PAWS:", packetString(packet))
+		return
+	}
+
+	// an ack answering a keepalive probe repeats the client's last ack, it must
+	// not be answered or the client counts the answers as duplicate acks
+	probed := serverCtx.Probes > 0
+	serverCtx.Packet = packet
+	serverCtx.LastHeard = time.Now()
+	serverCtx.Probes = 0
+
+	if flags.SYN {
+		receiveSyn(serverCtx, packet)
+	} else if flags.FIN {
+		receiveFin(serverCtx, packet)
+	} else if flags.PSH && flags.ACK {
+		receiveData(serverCtx, packet)
+	} else if flags.ACK {
+		if err := utils.Step(serverCtx.FSM, EVENT_RECEIVE_ACK); err != nil {
+			fmt.Println("ACK ignored:", err)
+			return
+		}
+		if probed {
+			fmt.Println("Received -> KEEPALIVE ACK with packet:", packetString(packet))
+			return
+		}
+		fmt.Println("Received -> WINDOW PROBE with packet:", packetString(packet))
+		send(serverCtx)
+	}
 }
 
-func receive(serverCtx *ServerCtx) {
-	buffer := make([]byte, 1024)
+func receiveSyn(serverCtx *ServerCtx, packet utils.Packet) {
+	fmt.Println("Received -> SYN with packet:", packetString(packet))
+	if err := utils.Step(serverCtx.FSM, EVENT_RECEIVE_SYN); err != nil {
+		fmt.Println("SYN ignored:", err)
+		return
+	}
 
-	if serverCtx.Timeout {
-		deadline := time.Now().Add(time.Duration(SERVER_DELAY_SECONDS) * time.Second)
-		serverCtx.Socket.SetReadDeadline(deadline)
+	serverCtx.RTO = utils.NewRTOEstimator()
+	if err := openConnection(serverCtx, packet); err != nil {
+		fmt.Println("Connection refused:", err)
+		sendReset(serverCtx, packet, utils.ResetReasonFor(err))
+		abortConnection(serverCtx)
+		return
+	}
+	if timestamp, ok := packet.Header.Timestamp(); ok {
+		serverCtx.TsRecent = timestamp.Val
 	}
+	sendSynAck(serverCtx)
+}
 
-	n, addr, err := serverCtx.Socket.ReadFromUDP(buffer)
-	if err != nil {
-		if serverCtx.Timeout {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				fmt.Println("Timeout waiting for PSH/ACK")
-				sendLastPacket(serverCtx)
-				// receive(serverCtx)
-			} else {
-				fmt.Println(err)
-				cleanup(serverCtx)
-			}
-		} else {
+// the client closed its side, the reply goes out before the server closes its
+// own
+func receiveFin(serverCtx *ServerCtx, packet utils.Packet) {
+	fmt.Println("Received -> FIN with packet:", packetString(packet))
+	if err := utils.Step(serverCtx.FSM, EVENT_RECEIVE_FIN); err != nil {
+		fmt.Println("Received -> FIN without a connection:", err)
+		sendReset(serverCtx, packet, utils.RESET_UNKNOWN_CONNECTION)
+		return
+	}
+
+	if len(serverCtx.Reply) > 0 {
+		sendReply(serverCtx)
+		return
+	}
+	sendFinAck(serverCtx)
+}
+
+func receiveData(serverCtx *ServerCtx, packet utils.Packet) {
+	if err := utils.Step(serverCtx.FSM, EVENT_RECEIVE_DATA); err != nil {
+		fmt.Println("Received -> PSH/ACK without a connection:", err)
+		sendReset(serverCtx, packet, utils.RESET_UNKNOWN_CONNECTION)
+		return
+	}
+
+	fmt.Println("Received -> PSH/ACK with packet:", packetString(packet))
+	end := packet.Header.Seq + packet.Header.Len
+	if packet.Header.Ack != serverCtx.ISN+1 {
+		fmt.Println("Segment from an earlier connection discarded:", packetString(packet))
+	} else if utils.SeqGT(end, serverCtx.Buffer.Next) && end-serverCtx.Buffer.Next > uint32(serverCtx.ReceiveWindow) {
+		fmt.Println("Segment outside receive window discarded:", packetString(packet))
+	} else if !serverCtx.Buffer.Insert(packet.Header.Seq, packet.Data) {
+		fmt.Println("Duplicate segment discarded:", packetString(packet))
+	} else if packet.Header.Seq != serverCtx.Buffer.Next {
+		fmt.Println("Out of order segment buffered:", packetString(packet))
+	}
+	if !deliver(serverCtx) {
+		return
+	}
+
+	send(serverCtx)
+}
+
+// the established connection went quiet, either the client is probed or the
+// last ack is sent again
+func receiveTimeout(serverCtx *ServerCtx) {
+	if idle(serverCtx) {
+		keepalive(serverCtx)
+	} else if receivingData(serverCtx) {
+		if err := utils.Step(serverCtx.FSM, EVENT_ACK_TIMEOUT); err != nil {
 			fmt.Println(err)
-			cleanup(serverCtx)
+			return
 		}
+		fmt.Println("Timeout waiting for PSH/ACK")
+		sendLastPacket(serverCtx)
+	}
+}
+
+// free space in the reassembly buffer, received bytes are written out as soon
+// as they are in order so only the out of order ones take up room
+func advertisedWindow(serverCtx *ServerCtx) uint32 {
+	if serverCtx.Buffer == nil {
+		return uint32(serverCtx.ReceiveWindow)
+	}
+	return uint32(max(0, serverCtx.ReceiveWindow-serverCtx.Buffer.Buffered()))
+}
+
+// the ack resend timer while data is arriving, otherwise the keepalive timer
+func readDeadline(serverCtx *ServerCtx) time.Time {
+	if serverCtx.Probes > 0 {
+		return time.Now().Add(serverCtx.KeepaliveInterval)
+	}
+
+	deadline := serverCtx.LastHeard.Add(serverCtx.KeepaliveIdle)
+	if resend := time.Now().Add(serverCtx.RTO.RTO); receivingData(serverCtx) && resend.Before(deadline) {
+		return resend
+	}
+	return deadline
+}
+
+// data has arrived since the connection was established, before that there is
+// no ack worth resending
+func receivingData(serverCtx *ServerCtx) bool {
+	return serverCtx.Delivered > 0 || serverCtx.Buffer.Buffered() > 0
+}
+
+func idle(serverCtx *ServerCtx) bool {
+	return time.Since(serverCtx.LastHeard) >= serverCtx.KeepaliveIdle
+}
+
+// probes a quiet client, and gives up on the transfer once too many probes
+// went unanswered
+func keepalive(serverCtx *ServerCtx) {
+	if err := utils.Step(serverCtx.FSM, EVENT_KEEPALIVE_TIMEOUT); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if serverCtx.Probes >= serverCtx.KeepaliveCount {
+		fmt.Printf("Connection dropped: %v after %d keepalive probes\n", utils.ErrPeerDead, serverCtx.Probes)
+		abortConnection(serverCtx)
+		return
+	}
+
+	serverCtx.Probes++
+	sendKeepalive(serverCtx)
+}
+
+// an ack for one byte before what the client already has, which it answers
+// with an ack. it is not kept in lastSent so sendLastPacket never repeats it
+func sendKeepalive(serverCtx *ServerCtx) {
+	packet := utils.Packet{
+		SrcAddr: serverCtx.Packet.SrcAddr,
+		DstAddr: serverCtx.Packet.DstAddr,
+		Header:  utils.Header{Flags: utils.Flags{ACK: true}, Seq: serverCtx.ISN, Ack: serverCtx.Buffer.Next, Window: advertisedWindow(serverCtx)},
 	}
+	stampPacket(serverCtx, &packet)
 
-	bytes := buffer[0:n]
-	var packet utils.Packet
+	bytes, err := utils.EncodePacket(packet)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-	packet, err = utils.DecodePacket(bytes)
+	_, err = serverCtx.Socket.WriteToUDP(bytes, serverCtx.ClientAddress)
 	if err != nil {
 		fmt.Println(err)
 		cleanup(serverCtx)
 	}
 
-	// if len(bytes) != 0 {
-	// 	packet, err = utils.DecodePacket(bytes)
-	// 	if packet.Header.Flags.ACK && !packet.Header.Flags.PSH && !serverCtx.Timeout {
-	// 		receive(serverCtx)
-	// 	}
-	// 	if err != nil {
-	// 		fmt.Println(err)
-	// 		cleanup(serverCtx)
-	// 	}
-	// } else {
-	// 	receive(serverCtx)
-	// }
-
-	serverCtx.packetsReceived = append(serverCtx.packetsReceived, packet)
-	serverCtx.ClientAddress = addr
-	serverCtx.Packet = packet
+	fmt.Printf("Send -> KEEPALIVE %d/%d with packet: %s\n", serverCtx.Probes, serverCtx.KeepaliveCount, packetString(packet))
+}
 
-	if packet.Header.Flags.SYN {
-		fmt.Println("Received -> SYN with packet:", packetString(packet))
-		sendSynAck(serverCtx)
+// starts the reply once the client has closed its side. the client's fin is
+// acked first so it knows its data arrived, then the reply goes out through a
+// sliding window the same way the client sends its file
+func sendReply(serverCtx *ServerCtx) {
+	fin := serverCtx.Packet
+	finAck := fin.Header.Seq + fin.Header.Len
+	serverCtx.Buffer.Next = finAck
+	sendReplyAck(serverCtx, finAck)
+
+	serverCtx.ReplyWindow = utils.NewSendWindow(buildReply(serverCtx, finAck), REPLY_WINDOW_SIZE)
+	serverCtx.ReplyWindow.Advertise(serverCtx.SendNext, fin.Header.Window)
+	serverCtx.ReplyFin = fin
+	serverCtx.ReplyRetries = 0
+	fillReplyWindow(serverCtx)
+}
+
+func fillReplyWindow(serverCtx *ServerCtx) {
+	for serverCtx.ReplyWindow.CanSend() {
+		segment := serverCtx.ReplyWindow.Take()
+		sendReplySegment(serverCtx, segment)
+		fmt.Println("Send -> PSH/ACK with packet:", packetString(segment.Packet))
+	}
+}
+
+func receiveReplyAck(serverCtx *ServerCtx, packet utils.Packet) {
+	window := serverCtx.ReplyWindow
+	serverCtx.LastHeard = time.Now()
+	serverCtx.ReplyRetries = 0
+
+	if packet.Header.Flags.RST {
+		receiveReset(serverCtx, packet)
+		return
 	} else if packet.Header.Flags.FIN {
-		fmt.Println("Received -> FIN with packet:", packetString(packet))
-		sendFinAck(serverCtx)
-	} else if packet.Header.Flags.PSH && packet.Header.Flags.ACK {
-		fmt.Printf("Received -> %s with packet: %s", "packet.Data", packetString(packet))
-		serverCtx.Timeout = true
-		send(serverCtx)
+		fmt.Println("Received -> REPEAT FIN with packet:", packetString(packet))
+		if err := utils.Step(serverCtx.FSM, EVENT_RECEIVE_FIN); err != nil {
+			fmt.Println(err)
+			return
+		}
+		sendReplyAck(serverCtx, serverCtx.Buffer.Next)
+		return
+	} else if !packet.Header.Flags.ACK || !checkTimestamp(serverCtx, packet) {
+		return
+	}
+
+	if err := utils.Step(serverCtx.FSM, EVENT_RECEIVE_REPLY_ACK); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	acked := window.Ack(packet.Header.Ack)
+	window.Sack(packet.Header.Sack)
+	window.Advertise(packet.Header.Ack, packet.Header.Window)
+	fmt.Printf("Received -> ACK with packet: %s (%d acked, %d in flight)\n", packetString(packet), len(acked), window.InFlight())
+
+	if len(acked) > 0 {
+		newest := acked[len(acked)-1]
+		serverCtx.SentAt = newest.SentAt
+		serverCtx.Retransmitted = newest.Retransmitted || newest.Sacked
+		sampleRtt(serverCtx, packet)
+	}
+
+	for _, segment := range window.Missing() {
+		if segment.Retransmitted {
+			continue
+		}
+		segment.Retransmitted = true
+		sendReplySegment(serverCtx, segment)
+		fmt.Println("Re-Send -> SACK PSH/ACK with packet:", packetString(segment.Packet))
+	}
+
+	if window.Done() {
+		finishReply(serverCtx)
+		return
+	}
+	fillReplyWindow(serverCtx)
+}
+
+func replyTimeout(serverCtx *ServerCtx) {
+	window := serverCtx.ReplyWindow
+	if err := utils.Step(serverCtx.FSM, EVENT_REPLY_TIMEOUT); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	serverCtx.ReplyRetries++
+	if serverCtx.ReplyRetries > RESEND_LIMIT {
+		fmt.Println("Passed reply resending limit")
+		sendReset(serverCtx, serverCtx.Packet, utils.RESET_TIMEOUT)
+		abortConnection(serverCtx)
+		return
+	}
+
+	fmt.Println("Timeout waiting for ACK -> re-sending packet")
+	serverCtx.RTO.Backoff()
+	fmt.Println(serverCtx.RTO)
+	if window.InFlight() > 0 {
+		oldest := window.Oldest()
+		oldest.Retransmitted = true
+		sendReplySegment(serverCtx, oldest)
+		fmt.Println("Re-Send -> PSH/ACK with packet:", packetString(oldest.Packet))
+	} else {
+		// the client's window is closed, the next segment probes it
+		segment := window.Take()
+		sendReplySegment(serverCtx, segment)
+		fmt.Println("Send -> WINDOW PROBE with packet:", packetString(segment.Packet))
 	}
-	receive(serverCtx)
+}
+
+// the whole reply was acked, the server closes its side
+func finishReply(serverCtx *ServerCtx) {
+	serverCtx.SendNext += uint32(len(serverCtx.Reply))
+	serverCtx.Packet = serverCtx.ReplyFin
+	serverCtx.ReplyWindow = nil
+	sendFinAck(serverCtx)
+}
+
+func buildReply(serverCtx *ServerCtx, ack uint32) []utils.Packet {
+	var packets []utils.Packet
+
+	chunkSize := serverCtx.Negotiated.Payload()
+	for i := 0; i < len(serverCtx.Reply); i += chunkSize {
+		chunk := serverCtx.Reply[i:min(len(serverCtx.Reply), i+chunkSize)]
+
+		packets = append(packets, utils.Packet{
+			SrcAddr: serverCtx.Packet.SrcAddr,
+			DstAddr: serverCtx.Packet.DstAddr,
+			Header:  utils.Header{Flags: utils.Flags{PSH: true, ACK: true}, Seq: serverCtx.SendNext + uint32(i), Ack: ack, Len: uint32(len(chunk))},
+			Data:    chunk,
+		})
+	}
+
+	return packets
+}
+
+func sendReplySegment(serverCtx *ServerCtx, segment *utils.Segment) {
+	packet := segment.Packet
+	packet.Header.Flags.DUP = segment.Retransmitted
+	packet.Header.Window = advertisedWindow(serverCtx)
+	stampPacket(serverCtx, &packet)
+
+	writePacket(serverCtx, packet)
+	segment.SentAt = time.Now()
+}
+
+// acks the client's fin without closing the server's side
+func sendReplyAck(serverCtx *ServerCtx, ack uint32) {
+	packet := utils.Packet{
+		SrcAddr: serverCtx.Packet.SrcAddr,
+		DstAddr: serverCtx.Packet.DstAddr,
+		Header:  utils.Header{Flags: utils.Flags{ACK: true}, Seq: serverCtx.SendNext, Ack: ack, Window: advertisedWindow(serverCtx)},
+	}
+	stampPacket(serverCtx, &packet)
+
+	writePacket(serverCtx, packet)
+	fmt.Println("Send -> ACK with packet:", packetString(packet))
+}
+
+func writePacket(serverCtx *ServerCtx, packet utils.Packet) {
+	bytes, err := utils.EncodePacket(packet)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	_, err = serverCtx.Socket.WriteToUDP(bytes, serverCtx.ClientAddress)
+	if err != nil {
+		fmt.Println(err)
+		cleanup(serverCtx)
+	}
+}
+
+// adds the timestamp option once both sides agreed to use it
+func stampPacket(serverCtx *ServerCtx, packet *utils.Packet) {
+	if serverCtx.Options[utils.OPTION_TIMESTAMP] {
+		packet.Header.SetTimestamp(utils.Timestamp{Val: utils.TimestampNow(), Ecr: serverCtx.TsRecent})
+	}
+}
+
+// false for a segment whose timestamp is older than one already accepted, a
+// newer timestamp is kept for echoing if the segment reaches the left edge of
+// the window, so the echo covers the whole time the client waited
+func checkTimestamp(serverCtx *ServerCtx, packet utils.Packet) bool {
+	timestamp, ok := packet.Header.Timestamp()
+	if !ok || !serverCtx.Options[utils.OPTION_TIMESTAMP] {
+		return true
+	}
+
+	if utils.StaleTimestamp(timestamp.Val, serverCtx.TsRecent) {
+		return false
+	}
+
+	if serverCtx.Buffer == nil || utils.SeqLEQ(packet.Header.Seq, serverCtx.Buffer.Next) {
+		serverCtx.TsRecent = timestamp.Val
+	}
+	return true
+}
+
+// starts a new transfer, a repeated syn for the transfer in progress is ignored
+func openConnection(serverCtx *ServerCtx, syn utils.Packet) error {
+	next := syn.Header.Seq + syn.Header.Len
+	if serverCtx.Buffer != nil && serverCtx.Buffer.Next == next && serverCtx.Delivered == 0 {
+		return nil
+	}
+
+	negotiated, err := serverCtx.Limits.Negotiate(&syn.Header)
+	if err != nil {
+		return err
+	}
+
+	discardOutput(serverCtx)
+
+	output, err := utils.CreateOutputFile(serverCtx.OutputDir, serverCtx.OutputName, serverCtx.Collision)
+	if err != nil {
+		return err
+	}
+
+	serverCtx.Negotiated = negotiated
+	serverCtx.Options = utils.SupportedOptions().Intersect(syn.Header.OptionSet())
+	fmt.Printf("Negotiated %s, options: %s\n", serverCtx.Negotiated, serverCtx.Options)
+
+	serverCtx.ISN = utils.RandomISN()
+	serverCtx.SendNext = serverCtx.ISN + 1
+	serverCtx.Buffer = utils.NewReceiveBuffer(next)
+	serverCtx.Output = output
+	serverCtx.Delivered = 0
+	return nil
+}
+
+// aborts a connection, the rst is not kept in lastSent since it is never
+// repeated
+func sendReset(serverCtx *ServerCtx, cause utils.Packet, reason utils.ResetReason) {
+	packet := utils.Packet{
+		SrcAddr: cause.SrcAddr,
+		DstAddr: cause.DstAddr,
+		Header:  utils.Header{Flags: utils.Flags{RST: true}, Seq: cause.Header.Ack, Ack: cause.Header.Seq + cause.Header.Len},
+	}
+	packet.Header.SetResetReason(reason)
+
+	bytes, err := utils.EncodePacket(packet)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	_, err = serverCtx.Socket.WriteToUDP(bytes, serverCtx.ClientAddress)
+	if err != nil {
+		fmt.Println(err)
+		cleanup(serverCtx)
+	}
+
+	fmt.Printf("Send -> RST (%s) with packet: %s\n", reason, packetString(packet))
+}
+
+// drops the connection the client aborted
+func receiveReset(serverCtx *ServerCtx, packet utils.Packet) {
+	if serverCtx.FSM.Current() == utils.CLOSED {
+		fmt.Println("Received -> RST without a connection, ignored:", packetString(packet))
+		return
+	}
+	// a reset from the client carries the sequence number after everything it
+	// sent, one that isn't in the window could be a stray or forged one
+	if serverCtx.Buffer == nil || !utils.SeqInWindow(packet.Header.Seq, serverCtx.Buffer.Next, advertisedWindow(serverCtx)) {
+		fmt.Println("Received -> RST outside the window, ignored:", packetString(packet))
+		return
+	}
+
+	fmt.Printf("Received -> RST (%s) with packet: %s\n", packet.Header.ResetReason(), packetString(packet))
+	fmt.Println("Connection reset")
+	abortConnection(serverCtx)
+}
+
+// closes the connection from whatever state it is in, reaching CLOSED discards
+// the transfer
+func abortConnection(serverCtx *ServerCtx) {
+	if err := utils.Step(serverCtx.FSM, EVENT_ABORT); err != nil {
+		fmt.Println(err)
+	}
+	serverCtx.ReplyWindow = nil
+	serverCtx.Probes = 0
+}
+
+// corrupt packets are left for the client to retransmit
+func dropCorrupt(server *Server) {
+	server.Corrupted++
+	fmt.Printf("Dropped corrupt packet (%d so far)\n", server.Corrupted)
+}
+
+// passes the contiguous bytes in the reassembly buffer up to the output file,
+// false if the transfer had to be aborted
+func deliver(serverCtx *ServerCtx) bool {
+	data := serverCtx.Buffer.Read()
+	if len(data) == 0 {
+		return true
+	}
+
+	if err := serverCtx.Output.Write([]byte(data)); err != nil {
+		fmt.Println("Transfer aborted:", err)
+		sendReset(serverCtx, serverCtx.Packet, utils.ResetReasonFor(err))
+		abortConnection(serverCtx)
+		return false
+	}
+
+	serverCtx.Delivered += len(data)
+	fmt.Printf("Delivered %d bytes (%d total, %d buffered out of order)\n", len(data), serverCtx.Delivered, serverCtx.Buffer.Buffered())
+	return true
+}
+
+// only called once the fin/ack exchange completed cleanly
+func commitOutput(serverCtx *ServerCtx) {
+	if serverCtx.Output == nil {
+		return
+	}
+
+	path, err := serverCtx.Output.Commit()
+	if err != nil {
+		fmt.Println("Transfer not saved:", err)
+	} else {
+		fmt.Printf("Saved %d bytes to %s\n", serverCtx.Delivered, path)
+	}
+
+	serverCtx.Output = nil
+	serverCtx.Buffer = nil
+}
+
+func discardOutput(serverCtx *ServerCtx) {
+	if serverCtx.Output == nil {
+		return
+	}
+
+	serverCtx.Output.Discard()
+	fmt.Println("Discarded incomplete transfer")
+
+	serverCtx.Output = nil
+	serverCtx.Buffer = nil
 }
 
 func sendLastPacket(serverCtx *ServerCtx) {
-	lastPacketSent := serverCtx.packetsSent[len(serverCtx.packetsSent)-1]
+	lastPacketSent := serverCtx.lastSent
 
 	lastPacketSent.Header.Flags.DUP = true
+	stampPacket(serverCtx, &lastPacketSent)
 
 	bytes, err := utils.EncodePacket(lastPacketSent)
 	if err != nil {
@@ -190,42 +906,30 @@ func sendLastPacket(serverCtx *ServerCtx) {
 		cleanup(serverCtx)
 	}
 
-	serverCtx.packetsSent = append(serverCtx.packetsSent, lastPacketSent)
+	serverCtx.lastSent = lastPacketSent
+	serverCtx.Retransmitted = true
+	serverCtx.SentAt = time.Now()
+	fmt.Printf("Re-Send -> %s with packet: %s\n", packetName(lastPacketSent), packetString(lastPacketSent))
+}
 
-	if lastPacketSent.Header.Flags.ACK && lastPacketSent.Header.Flags.FIN {
-		fmt.Println("Re-Send -> FIN/ACK with packet: ", packetString(lastPacketSent))
-		serverCtx.TerminationCount++
-		if serverCtx.TerminationCount >= 7 {
-			fmt.Println("Passed FIN/ACK resending limit")
-			fmt.Println("Connection terminated")
-			serverCtx.Timeout = false
-			serverCtx.Socket.SetReadDeadline(time.Time{})
-			receive(serverCtx)
-		}
-		waitForAck(serverCtx)
-	} else if lastPacketSent.Header.Flags.ACK && lastPacketSent.Header.Flags.SYN {
-		fmt.Println("Re-Send -> SYN/ACK with packet: ", packetString(lastPacketSent))
-		serverCtx.EstablishCount++
-		if serverCtx.EstablishCount >= 7 {
-			fmt.Println("Passed SYN/ACK resending limit")
-			fmt.Println("Connection terminated")
-			serverCtx.Timeout = false
-			serverCtx.Socket.SetReadDeadline(time.Time{})
-			receive(serverCtx)
-		}
-		waitForAck(serverCtx)
-	} else {
-		fmt.Println("Re-Send -> ACK with packet: ", packetString(lastPacketSent))
-		receive(serverCtx)
+func packetName(packet utils.Packet) string {
+	if packet.Header.Flags.SYN {
+		return "SYN/ACK"
+	} else if packet.Header.Flags.FIN {
+		return "FIN/ACK"
 	}
+	return "ACK"
 }
 
 func sendSynAck(serverCtx *ServerCtx) {
 	packet := utils.Packet{
 		SrcAddr: serverCtx.Packet.SrcAddr,
 		DstAddr: serverCtx.Packet.DstAddr,
-		Header:  utils.Header{Flags: utils.Flags{SYN: true, ACK: true}, Seq: 0, Ack: 1, Len: 1},
+		Header:  utils.Header{Flags: utils.Flags{SYN: true, ACK: true}, Seq: serverCtx.ISN, Ack: serverCtx.Buffer.Next, Len: 1, Window: advertisedWindow(serverCtx)},
 	}
+	serverCtx.Limits.SetOptions(&packet.Header)
+	stampPacket(serverCtx, &packet)
+	serverCtx.ExpectedAck = serverCtx.ISN + 1
 
 	bytes, err := utils.EncodePacket(packet)
 	if err != nil {
@@ -239,97 +943,262 @@ func sendSynAck(serverCtx *ServerCtx) {
 		cleanup(serverCtx)
 	}
 
-	serverCtx.packetsSent = append(serverCtx.packetsSent, packet)
+	serverCtx.lastSent = packet
+	serverCtx.SentAt = time.Now()
+	serverCtx.Retransmitted = false
+	serverCtx.Resends = 0
 	fmt.Println("Send -> SYN/ACK with packet:", packetString(packet))
-	waitForAck(serverCtx)
 }
 
-func waitForAck(serverCtx *ServerCtx) {
-	buffer := make([]byte, 1024)
+// the syn/ack or fin/ack was not acked in time, it is resent until the limit
+func ackTimeout(serverCtx *ServerCtx) {
+	event := EVENT_SYN_ACK_TIMEOUT
+	if serverCtx.FSM.Current() == utils.LAST_ACK {
+		event = EVENT_FIN_TIMEOUT
+	}
+	if err := utils.Step(serverCtx.FSM, event); err != nil {
+		fmt.Println(err)
+		return
+	}
 
-	deadline := time.Now().Add(time.Duration(SERVER_DELAY_SECONDS) * time.Second)
-	serverCtx.Socket.SetReadDeadline(deadline)
+	if serverCtx.Resends >= RESEND_LIMIT {
+		fmt.Printf("Passed %s resending limit\n", packetName(serverCtx.lastSent))
+		fmt.Println("Connection terminated")
+		abortConnection(serverCtx)
+		return
+	}
+	serverCtx.Resends++
 
-	n, _, err := serverCtx.Socket.ReadFromUDP(buffer)
-	if err != nil {
-		if netError, ok := err.(net.Error); ok && netError.Timeout() {
-			fmt.Println("Timeout waiting for ACK -> re-sending packet")
-			sendLastPacket(serverCtx)
-		} else {
-			fmt.Println(err)
-			cleanup(serverCtx)
+	fmt.Println("Timeout waiting for ACK -> re-sending packet")
+	serverCtx.RTO.Backoff()
+	fmt.Println(serverCtx.RTO)
+	sendLastPacket(serverCtx)
+}
+
+// a packet for a connection whose syn/ack or fin/ack is waiting to be acked
+func receiveAck(serverCtx *ServerCtx, packet utils.Packet) {
+	if packet.Header.Flags.RST {
+		receiveReset(serverCtx, packet)
+		return
+	}
+
+	// the client missed the syn/ack
+	if packet.Header.Flags.SYN {
+		receiveSyn(serverCtx, packet)
+		return
+	}
+
+	// anything that does not ack the syn/ack or fin/ack is left over from an
+	// earlier connection
+	if packet.Header.Flags.ACK && packet.Header.Ack != serverCtx.ExpectedAck {
+		fmt.Println("Stale ACK discarded:", packetString(packet))
+		return
+	}
+
+	if !checkTimestamp(serverCtx, packet) {
+		fmt.Println("Old duplicate rejected by PAWS:", packetString(packet))
+		return
+	}
+
+	// a repeated fin is answered by the fin/ack's own timer
+	if packet.Header.Flags.FIN {
+		if err := utils.Step(serverCtx.FSM, EVENT_RECEIVE_FIN); err != nil {
+			fmt.Println("FIN ignored:", err)
 		}
+		return
+	} else if !packet.Header.Flags.ACK {
+		fmt.Println("The packet wasn't an ACK packet")
+		return
 	}
+	serverCtx.LastHeard = time.Now()
+	sampleRtt(serverCtx, packet)
+	fmt.Println("Received -> ACK with packet:", packetString(packet))
 
-	bytes := buffer[0:n]
+	if serverCtx.FSM.Current() == utils.LAST_ACK {
+		fmt.Println("Connection terminated")
+		commitOutput(serverCtx)
+		if err := utils.Step(serverCtx.FSM, EVENT_RECEIVE_LAST_ACK); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
 
-	packet, err := utils.DecodePacket(bytes)
-	if err != nil {
+	fmt.Println("Connection established")
+	if err := utils.Step(serverCtx.FSM, EVENT_RECEIVE_ACK); err != nil {
 		fmt.Println(err)
-		cleanup(serverCtx)
 	}
+}
 
-	lastPacketReceived := serverCtx.packetsReceived[len(serverCtx.packetsReceived)-1]
-	serverCtx.packetsReceived = append(serverCtx.packetsReceived, packet)
+// karn's rule, without timestamps an ack for a retransmitted syn/ack or
+// fin/ack is not sampled
+func sampleRtt(serverCtx *ServerCtx, packet utils.Packet) {
+	rtt := time.Since(serverCtx.SentAt)
 
-	if packet.Header.Flags.ACK && lastPacketReceived.Header.Flags.SYN {
-		fmt.Println("Received -> ACK with packet:", packetString(packet))
-		fmt.Println("Connection established")
-		serverCtx.Timeout = false
-		serverCtx.Socket.SetReadDeadline(time.Time{})
-		receive(serverCtx)
-	} else if packet.Header.Flags.ACK && lastPacketReceived.Header.Flags.FIN {
-		fmt.Println("Received -> ACK with packet:", packetString(packet))
-		fmt.Println("Connection terminated")
-		serverCtx.Timeout = false
-		serverCtx.Socket.SetReadDeadline(time.Time{})
-		receive(serverCtx)
-	} else {
-		fmt.Println("The packet wasn't an ACK packet")
-		waitForAck(serverCtx)
+	timestamp, ok := packet.Header.Timestamp()
+	if echoed, valid := utils.TimestampRTT(timestamp.Ecr); ok && valid && serverCtx.Options[utils.OPTION_TIMESTAMP] {
+		rtt = echoed
+	} else if serverCtx.Retransmitted {
+		return
 	}
+
+	serverCtx.RTO.Sample(rtt)
+	fmt.Println(serverCtx.RTO)
 }
 
-func bindSocket(serverCtx *ServerCtx) {
-	s, err := net.ResolveUDPAddr("udp", utils.Address(serverCtx.Ip, serverCtx.Port))
+func bindSocket(server *Server) {
+	s, err := net.ResolveUDPAddr("udp", utils.Address(server.Ip, server.Port))
 	if err != nil {
 		fmt.Println(err)
-		exit(serverCtx)
+		exit(server)
 	}
 
 	connection, err := net.ListenUDP("udp", s)
 	if err != nil {
 		fmt.Println(err)
-		exit(serverCtx)
+		exit(server)
 	}
 
-	serverCtx.Socket = connection
+	server.Socket = connection
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Server receives files from the client\n\n")
+
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n\n")
+
+	fmt.Fprintf(flag.CommandLine.Output(), "  go run server/server.go [flags] <ip> <port>\n\n")
+
+	fmt.Fprintf(flag.CommandLine.Output(), "Arguments:\n\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  ip\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "\tip address for server to bind to\n")
+
+	fmt.Fprintf(flag.CommandLine.Output(), "  port\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "\tport for server to bind to\n")
+
+	fmt.Fprintf(flag.CommandLine.Output(), "Flags:\n\n")
+	flag.PrintDefaults()
 }
 
-func checkArgs(serverCtx *ServerCtx) {
-	if utils.Address(serverCtx.Ip, serverCtx.Port) == "" {
-		fmt.Printf("%s and %s is not a valid ip and port combination", serverCtx.Ip, serverCtx.Port)
-		exit(serverCtx)
+func checkArgs(server *Server) {
+	if utils.Address(server.Ip, server.Port) == "" {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s and %s is not a valid ip and port combination\n", server.Ip, server.Port)
+		usage()
+		exit(server)
+	}
+
+	if server.ReceiveWindow < 1 {
+		fmt.Fprintln(flag.CommandLine.Output(), "-rcvbuf must be at least 1")
+		usage()
+		exit(server)
+	}
+
+	if server.KeepaliveIdle <= 0 || server.KeepaliveInterval <= 0 || server.KeepaliveCount < 1 {
+		fmt.Fprintln(flag.CommandLine.Output(), "-keepalive, -keepalive-interval and -keepalive-count must be positive")
+		usage()
+		exit(server)
+	}
+
+	if info, err := os.Stat(server.OutputDir); err != nil || !info.IsDir() {
+		fmt.Fprintf(flag.CommandLine.Output(), "-dir %s is not a directory\n", server.OutputDir)
+		usage()
+		exit(server)
 	}
 }
 
-func parseArgs(serverCtx *ServerCtx) {
-	if len(os.Args) < 3 {
-		fmt.Println(INPUT_ERROR)
-		exit(serverCtx)
+func readReply(server *Server) {
+	if server.ReplyPath == "" {
+		return
 	}
 
-	serverCtx.Ip = os.Args[1]
-	serverCtx.Port = os.Args[2]
+	content, err := os.ReadFile(server.ReplyPath)
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		usage()
+		exit(server)
+	}
+	server.Reply = string(content)
+}
+
+func parseArgs(server *Server) {
+	outputDir := flag.String("dir", ".", "directory to write received files to")
+	outputName := flag.String("name", "received.txt", "file name for received files")
+	receiveWindow := flag.Int("rcvbuf", DEFAULT_RECEIVE_WINDOW, "bytes of out of order data the server will buffer")
+	replyPath := flag.String("reply", "", "file to send back once the client has sent its file")
+	collision := flag.String("collision", string(utils.SUFFIX), "what to do when the file name is taken (overwrite, suffix, reject)")
+	codec := flag.String("codec", string(utils.BINARY), "packet encoding (binary, gob)")
+	mss := flag.Int("mss", utils.DEFAULT_MSS, "largest segment payload to accept, in bytes")
+	datagram := flag.Int("datagram", 0, "largest datagram to accept, in bytes, 0 fits the mss")
+	keepaliveIdle := flag.Duration("keepalive", utils.KEEPALIVE_IDLE, "how long a connection can be quiet before the client is probed")
+	keepaliveInterval := flag.Duration("keepalive-interval", utils.KEEPALIVE_INTERVAL, "time between keepalive probes")
+	keepaliveCount := flag.Int("keepalive-count", utils.KEEPALIVE_COUNT, "unanswered keepalive probes before the connection is dropped")
+	diagrams := flag.String("diagrams", "", "write the connection state diagrams to this directory and exit")
+
+	flag.CommandLine.Usage = usage
+	flag.Parse()
+
+	if *diagrams != "" {
+		if err := utils.WriteDiagrams(buildFSM(nil), *diagrams, "server"); err != nil {
+			fmt.Println("Couldn't write the state diagrams:", err)
+		}
+		exit(server)
+	}
+
+	if len(flag.Args()) < 2 {
+		fmt.Fprintln(flag.CommandLine.Output(), "not enough arguments")
+		usage()
+		exit(server)
+	}
 
-	checkArgs(serverCtx)
+	server.Ip = flag.Args()[0]
+	server.Port = flag.Args()[1]
 
-	fmt.Printf("The UDP server is %s\n", utils.Address(serverCtx.Ip, serverCtx.Port))
+	policy, err := utils.ParseCollisionPolicy(*collision)
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		usage()
+		exit(server)
+	}
+
+	server.OutputDir = *outputDir
+	server.OutputName = filepath.Base(*outputName)
+	server.Collision = policy
+	server.ReceiveWindow = *receiveWindow
+	server.ReplyPath = *replyPath
+	server.KeepaliveIdle = *keepaliveIdle
+	server.KeepaliveInterval = *keepaliveInterval
+	server.KeepaliveCount = *keepaliveCount
+
+	if err := utils.SetCodec(*codec); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		usage()
+		exit(server)
+	}
+
+	limits, err := utils.NewLimits(*mss, *datagram)
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		usage()
+		exit(server)
+	}
+	server.Limits = limits
+
+	checkArgs(server)
+	readReply(server)
+
+	fmt.Printf("The UDP server is %s\n", utils.Address(server.Ip, server.Port))
 }
 
 func main() {
-	serverCtx := ServerCtx{}
-	parseArgs(&serverCtx)
-	bindSocket(&serverCtx)
-	receive(&serverCtx)
+	// every connection builds its own machine, a broken definition should stop
+	// the server here rather than when the first client connects
+	if err := fsm.Validate(utils.CLOSED, transitions, connectionActions(nil)); err != nil {
+		fmt.Println(err)
+		fmt.Println("Exiting...")
+		os.Exit(EXIT_INVALID_FSM)
+	}
+
+	server := Server{connections: make(map[string]*ServerCtx)}
+	parseArgs(&server)
+	bindSocket(&server)
+	listen(&server)
 }
@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// congestion windows are counted in segments
+type CongestionController interface {
+	// acked is the number of segments newly acknowledged
+	OnAck(acked int)
+	// timeout is true when the retransmission timer expired, false when the
+	// loss was inferred from the acks the receiver sent, which starts fast
+	// recovery
+	OnLoss(timeout bool)
+	// every duplicate ack during fast recovery means a segment left the
+	// network, so the window is inflated to keep new data flowing
+	OnDupAck()
+	// fast recovery ended, the inflation is taken back out
+	OnRecovered()
+	Window() int
+}
+
+const (
+	INITIAL_CWND     float64 = 2
+	INITIAL_SSTHRESH float64 = math.MaxInt32
+	MIN_SSTHRESH     float64 = 2
+	CUBIC_BETA       float64 = 0.7
+	CUBIC_C          float64 = 0.4
+)
+
+func NewCongestionController(name string, fixedWindow int) (CongestionController, error) {
+	switch name {
+	case "reno":
+		return NewReno(), nil
+	case "cubic":
+		return NewCubic(), nil
+	case "fixed":
+		return &Fixed{Size: fixedWindow}, nil
+	}
+	return nil, fmt.Errorf("unknown congestion control: %s", name)
+}
+
+// slow start, additive increase and halving on loss
+type Reno struct {
+	Cwnd, Ssthresh float64
+	inflation      float64
+}
+
+func NewReno() *Reno {
+	return &Reno{Cwnd: INITIAL_CWND, Ssthresh: INITIAL_SSTHRESH}
+}
+
+func (reno *Reno) OnAck(acked int) {
+	for i := 0; i < acked; i++ {
+		if reno.Cwnd < reno.Ssthresh {
+			reno.Cwnd++
+		} else {
+			reno.Cwnd += 1 / reno.Cwnd
+		}
+	}
+}
+
+func (reno *Reno) OnLoss(timeout bool) {
+	reno.Ssthresh = math.Max(reno.Cwnd/2, MIN_SSTHRESH)
+	reno.inflation = 0
+	if timeout {
+		reno.Cwnd = 1
+	} else {
+		reno.Cwnd = reno.Ssthresh
+	}
+}
+
+func (reno *Reno) OnDupAck() {
+	reno.inflation++
+}
+
+func (reno *Reno) OnRecovered() {
+	reno.inflation = 0
+}
+
+func (reno *Reno) Window() int {
+	return int(reno.Cwnd + reno.inflation)
+}
+
+// grows the window along a cubic curve centred on the size it had at the
+// last loss, so it recovers quickly and then probes carefully
+type Cubic struct {
+	Cwnd, Ssthresh float64
+	WMax           float64
+	inflation      float64
+	epoch          time.Time
+}
+
+func NewCubic() *Cubic {
+	return &Cubic{Cwnd: INITIAL_CWND, Ssthresh: INITIAL_SSTHRESH}
+}
+
+func (cubic *Cubic) OnAck(acked int) {
+	if cubic.Cwnd < cubic.Ssthresh {
+		cubic.Cwnd = math.Min(cubic.Cwnd+float64(acked), cubic.Ssthresh)
+		return
+	}
+
+	if cubic.epoch.IsZero() {
+		cubic.epoch = time.Now()
+		if cubic.WMax < cubic.Cwnd {
+			cubic.WMax = cubic.Cwnd
+		}
+	}
+
+	k := math.Cbrt(cubic.WMax * (1 - CUBIC_BETA) / CUBIC_C)
+	t := time.Since(cubic.epoch).Seconds()
+	target := CUBIC_C*math.Pow(t-k, 3) + cubic.WMax
+
+	if target > cubic.Cwnd {
+		cubic.Cwnd += (target - cubic.Cwnd) / cubic.Cwnd * float64(acked)
+	} else {
+		cubic.Cwnd += 0.01 / cubic.Cwnd * float64(acked)
+	}
+}
+
+func (cubic *Cubic) OnLoss(timeout bool) {
+	cubic.WMax = cubic.Cwnd
+	cubic.epoch = time.Time{}
+	cubic.Ssthresh = math.Max(cubic.Cwnd*CUBIC_BETA, MIN_SSTHRESH)
+	cubic.inflation = 0
+	if timeout {
+		cubic.Cwnd = 1
+	} else {
+		cubic.Cwnd = cubic.Ssthresh
+	}
+}
+
+func (cubic *Cubic) OnDupAck() {
+	cubic.inflation++
+}
+
+func (cubic *Cubic) OnRecovered() {
+	cubic.inflation = 0
+}
+
+func (cubic *Cubic) Window() int {
+	return int(cubic.Cwnd + cubic.inflation)
+}
+
+// never changes, for comparing against a plain sliding window
+type Fixed struct {
+	Size int
+}
+
+func (fixed *Fixed) OnAck(acked int) {}
+
+func (fixed *Fixed) OnLoss(timeout bool) {}
+
+func (fixed *Fixed) OnDupAck() {}
+
+func (fixed *Fixed) OnRecovered() {}
+
+func (fixed *Fixed) Window() int {
+	return fixed.Size
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// how long a connection can go without hearing from the peer before it
+	// is probed
+	KEEPALIVE_IDLE = 5 * time.Second
+	// time between unanswered probes
+	KEEPALIVE_INTERVAL = 1 * time.Second
+	// unanswered probes before the peer is declared dead
+	KEEPALIVE_COUNT int = 5
+)
+
+var ErrPeerDead = errors.New("peer is not responding")
+
+// a keepalive probe is an ack whose seq is one before the sender's next
+// sequence number, so the receiver sees old data and answers with an ack
+func IsKeepalive(packet Packet, peerNext uint32) bool {
+	flags := packet.Header.Flags
+	return flags.ACK && !flags.SYN && !flags.FIN && !flags.PSH && packet.Header.Seq == peerNext-1 && len(packet.Data) == 0
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// what a peer that does not advertise its sizes is assumed to accept
+	DEFAULT_MSS           int = 512
+	DEFAULT_DATAGRAM_SIZE int = 1024
+
+	// the data length on the wire is 2 bytes
+	MAX_MSS int = 0xFFFF
+	// largest udp payload over ipv4
+	MAX_DATAGRAM_SIZE int = 65507
+	// the datagram size has to leave room for at least this much data, or
+	// the mss if that is smaller. a datagram sized for another codec's
+	// overhead would otherwise shrink every segment to a few bytes
+	MIN_PAYLOAD int = 64
+)
+
+var ErrSmallDatagram = errors.New("datagram size leaves too little room for data")
+
+// the largest segment payload and datagram a side is willing to receive
+type Limits struct {
+	MSS, Datagram int
+}
+
+// bytes an encoded packet takes up besides its payload with the current
+// codec and every registered option, gob lengths are varints so a few bytes
+// are left for them to grow
+func PacketOverhead() int {
+	ip := "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535"
+	packet := Packet{
+		SrcAddr: ip,
+		DstAddr: ip,
+		Header: Header{
+			Flags:  Flags{SYN: true, FIN: true, ACK: true, PSH: true, DUP: true},
+			Seq:    0xFFFFFFFF,
+			Ack:    0xFFFFFFFF,
+			Len:    0xFFFFFFFF,
+			Window: 0xFFFFFFFF,
+		},
+	}
+	for i := range packet.Header.Sack {
+		packet.Header.Sack[i] = SackBlock{Start: 0xFFFFFFFF, End: 0xFFFFFFFE}
+	}
+	packet.Header.Options = largestOptions()
+
+	encoded, err := EncodePacket(packet)
+	if err != nil {
+		return WIRE_HEADER_SIZE + MAX_SACK_BLOCKS*8 + MAX_OPTIONS_SIZE + CHECKSUM_SIZE
+	}
+	return len(encoded) + 8
+}
+
+// fills in a datagram size that fits the mss when none was given and checks
+// the two can be used together
+func NewLimits(mss, datagram int) (Limits, error) {
+	if mss < 1 || mss > MAX_MSS {
+		return Limits{}, fmt.Errorf("mss must be between 1 and %d", MAX_MSS)
+	}
+
+	if datagram == 0 {
+		datagram = min(mss+PacketOverhead(), MAX_DATAGRAM_SIZE)
+	}
+	smallest := PacketOverhead() + min(mss, MIN_PAYLOAD)
+	if datagram < smallest || datagram > MAX_DATAGRAM_SIZE {
+		return Limits{}, fmt.Errorf("datagram size must be between %d and %d", smallest, MAX_DATAGRAM_SIZE)
+	}
+
+	return Limits{MSS: mss, Datagram: datagram}, nil
+}
+
+// advertises the limits in a syn or syn/ack
+func (limits Limits) SetOptions(header *Header) {
+	header.SetUint16Option(OPTION_MSS, uint16(limits.MSS))
+	header.SetUint16Option(OPTION_DATAGRAM, uint16(limits.Datagram))
+}
+
+// the smaller of each limit and what the peer advertised in its syn or
+// syn/ack, a peer that left an option out gets the default for it. fails with
+// ErrSmallDatagram when the datagram size that comes out of it can't hold
+// MIN_PAYLOAD bytes of data
+func (limits Limits) Negotiate(header *Header) (Limits, error) {
+	peer := Limits{MSS: DEFAULT_MSS, Datagram: DEFAULT_DATAGRAM_SIZE}
+	if mss, ok := header.Uint16Option(OPTION_MSS); ok && mss > 0 {
+		peer.MSS = int(mss)
+	}
+	if datagram, ok := header.Uint16Option(OPTION_DATAGRAM); ok && datagram > 0 {
+		peer.Datagram = int(datagram)
+	}
+
+	negotiated := Limits{MSS: min(limits.MSS, peer.MSS), Datagram: min(limits.Datagram, peer.Datagram)}
+	if room := negotiated.Datagram - PacketOverhead(); room < min(negotiated.MSS, MIN_PAYLOAD) {
+		return negotiated, fmt.Errorf("%w, %d bytes per segment with a %d byte datagram", ErrSmallDatagram, max(0, room), negotiated.Datagram)
+	}
+	return negotiated, nil
+}
+
+// the most data one segment can carry without going over either limit
+func (limits Limits) Payload() int {
+	return max(1, min(limits.MSS, limits.Datagram-PacketOverhead()))
+}
+
+func (limits Limits) String() string {
+	return fmt.Sprintf("MSS: %d, datagram: %d", limits.MSS, limits.Datagram)
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNegotiateRejectsSmallDatagrams(t *testing.T) {
+	limits, err := NewLimits(DEFAULT_MSS, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		mss, datagram uint16
+		err           error
+	}{
+		{"room for the mss", uint16(DEFAULT_MSS), uint16(DEFAULT_MSS + PacketOverhead()), nil},
+		{"room for the minimum", uint16(DEFAULT_MSS), uint16(MIN_PAYLOAD + PacketOverhead()), nil},
+		{"room for a small mss", 10, uint16(10 + PacketOverhead()), nil},
+		{"short of the minimum", uint16(DEFAULT_MSS), uint16(MIN_PAYLOAD + PacketOverhead() - 1), ErrSmallDatagram},
+		{"smaller than the overhead", uint16(DEFAULT_MSS), uint16(PacketOverhead() / 2), ErrSmallDatagram},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := Header{}
+			Limits{MSS: int(test.mss), Datagram: int(test.datagram)}.SetOptions(&header)
+
+			_, err := limits.Negotiate(&header)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Negotiate returned %v, want %v", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// identifies an option on the wire, 0 is reserved as padding
+type OptionKind uint8
+
+const (
+	OPTION_MSS      OptionKind = 2
+	OPTION_DATAGRAM OptionKind = 3
+)
+
+// everything in the options area has to fit in its 1 byte length
+const MAX_OPTIONS_SIZE int = 0xFF
+
+// a value in the header's options, whose layout is given by the codec
+// registered for its kind
+type Option struct {
+	Kind OptionKind
+	Data []byte
+}
+
+// describes an option so packets carrying it can be checked, options whose
+// kind has no codec are skipped when a packet is read
+type OptionCodec struct {
+	Name string
+	// exact number of bytes in the value, -1 when any length is allowed
+	Size int
+}
+
+var optionCodecs = map[OptionKind]OptionCodec{}
+
+func init() {
+	RegisterOption(OPTION_MSS, OptionCodec{Name: "mss", Size: 2})
+	RegisterOption(OPTION_DATAGRAM, OptionCodec{Name: "datagram", Size: 2})
+}
+
+// adds support for an option, it has to be called before any packets are sent
+func RegisterOption(kind OptionKind, codec OptionCodec) error {
+	if kind == 0 {
+		return fmt.Errorf("option kind 0 is reserved")
+	}
+	if existing, ok := optionCodecs[kind]; ok {
+		return fmt.Errorf("option kind %d is already registered as %s", kind, existing.Name)
+	}
+	if codec.Size > MAX_OPTIONS_SIZE-2 {
+		return fmt.Errorf("option %s is too large", codec.Name)
+	}
+
+	optionCodecs[kind] = codec
+	return nil
+}
+
+// keeps the options this side understands, dropping ones with no codec or a
+// value of the wrong size
+func knownOptions(options []Option) []Option {
+	var known []Option
+	for _, option := range options {
+		codec, ok := optionCodecs[option.Kind]
+		if !ok || (codec.Size >= 0 && len(option.Data) != codec.Size) {
+			continue
+		}
+		known = append(known, option)
+	}
+	return known
+}
+
+// one of every registered option at its largest, for working out how much
+// room the options area can take up
+func largestOptions() []Option {
+	var options []Option
+	total := 0
+	for kind, codec := range optionCodecs {
+		size := codec.Size
+		if size < 0 {
+			size = MAX_OPTIONS_SIZE - 2
+		}
+		if total+2+size > MAX_OPTIONS_SIZE {
+			size = MAX_OPTIONS_SIZE - total - 2
+		}
+		if size < 0 {
+			break
+		}
+		options = append(options, Option{Kind: kind, Data: make([]byte, size)})
+		total += 2 + size
+	}
+	return options
+}
+
+func (header *Header) Option(kind OptionKind) ([]byte, bool) {
+	for _, option := range header.Options {
+		if option.Kind == kind {
+			return option.Data, true
+		}
+	}
+	return nil, false
+}
+
+// replaces the value if the option is already there, options are kept sorted
+// by kind so the same header always encodes the same way. the list is copied
+// first since copies of a packet share it
+func (header *Header) SetOption(kind OptionKind, data []byte) {
+	header.Options = slices.Clone(header.Options)
+	for i, option := range header.Options {
+		if option.Kind == kind {
+			header.Options[i].Data = data
+			return
+		}
+	}
+
+	header.Options = append(header.Options, Option{Kind: kind, Data: data})
+	sort.Slice(header.Options, func(i, j int) bool { return header.Options[i].Kind < header.Options[j].Kind })
+}
+
+func (header *Header) Uint16Option(kind OptionKind) (uint16, bool) {
+	data, ok := header.Option(kind)
+	if !ok || len(data) != 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(data), true
+}
+
+func (header *Header) SetUint16Option(kind OptionKind, value uint16) {
+	header.SetOption(kind, binary.BigEndian.AppendUint16(nil, value))
+}
+
+// the options a side put in its syn, which is how it says it supports them
+type OptionSet map[OptionKind]bool
+
+// every option this side has a codec for
+func SupportedOptions() OptionSet {
+	set := OptionSet{}
+	for kind := range optionCodecs {
+		set[kind] = true
+	}
+	return set
+}
+
+func (header *Header) OptionSet() OptionSet {
+	set := OptionSet{}
+	for _, option := range header.Options {
+		set[option.Kind] = true
+	}
+	return set
+}
+
+// the options both sides support, only these should be used after the
+// handshake
+func (set OptionSet) Intersect(other OptionSet) OptionSet {
+	both := OptionSet{}
+	for kind := range set {
+		if other[kind] {
+			both[kind] = true
+		}
+	}
+	return both
+}
+
+func (set OptionSet) String() string {
+	var names []string
+	for kind := range set {
+		if codec, ok := optionCodecs[kind]; ok {
+			names = append(names, codec.Name)
+		} else {
+			names = append(names, fmt.Sprint(kind))
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// what to do when a file with the output name already exists
+type CollisionPolicy string
+
+const (
+	OVERWRITE CollisionPolicy = "overwrite"
+	SUFFIX    CollisionPolicy = "suffix"
+	REJECT    CollisionPolicy = "reject"
+)
+
+var ErrFileExists = errors.New("output file already exists")
+
+func ParseCollisionPolicy(policy string) (CollisionPolicy, error) {
+	switch CollisionPolicy(policy) {
+	case OVERWRITE, SUFFIX, REJECT:
+		return CollisionPolicy(policy), nil
+	}
+	return "", fmt.Errorf("unknown collision policy: %s", policy)
+}
+
+// a transfer is written to a hidden temp file in the output directory and only
+// renamed to its final name once it is complete, so readers never see half of it
+type OutputFile struct {
+	file   *os.File
+	Dir    string
+	Name   string
+	Policy CollisionPolicy
+}
+
+func CreateOutputFile(dir string, name string, policy CollisionPolicy) (*OutputFile, error) {
+	// refused up front so the transfer is not sent for nothing, Commit still
+	// checks in case the name is taken in the meantime
+	if _, err := os.Stat(filepath.Join(dir, name)); policy == REJECT && err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrFileExists, name)
+	}
+
+	file, err := os.CreateTemp(dir, "."+name+".partial-*")
+	if err != nil {
+		return nil, err
+	}
+
+	// temp files are created private, received files should not be
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return &OutputFile{file: file, Dir: dir, Name: name, Policy: policy}, nil
+}
+
+func (output *OutputFile) Write(data []byte) error {
+	_, err := output.file.Write(data)
+	return err
+}
+
+// flushes the temp file and moves it to its final name, returns the final path
+func (output *OutputFile) Commit() (string, error) {
+	temp := output.file.Name()
+
+	if err := output.file.Sync(); err != nil {
+		output.Discard()
+		return "", err
+	}
+	if err := output.file.Close(); err != nil {
+		os.Remove(temp)
+		return "", err
+	}
+
+	path := filepath.Join(output.Dir, output.Name)
+
+	switch output.Policy {
+	case OVERWRITE:
+		if err := os.Rename(temp, path); err != nil {
+			os.Remove(temp)
+			return "", err
+		}
+		return path, nil
+	case REJECT:
+		// linking fails if the name is taken, unlike rename which replaces it
+		if err := os.Link(temp, path); err != nil {
+			os.Remove(temp)
+			if errors.Is(err, os.ErrExist) {
+				return "", ErrFileExists
+			}
+			return "", err
+		}
+		return path, os.Remove(temp)
+	}
+
+	ext := filepath.Ext(output.Name)
+	base := strings.TrimSuffix(output.Name, ext)
+	for i := 1; ; i++ {
+		err := os.Link(temp, path)
+		if err == nil {
+			return path, os.Remove(temp)
+		}
+		if !errors.Is(err, os.ErrExist) {
+			os.Remove(temp)
+			return "", err
+		}
+		path = filepath.Join(output.Dir, fmt.Sprintf("%s-%d%s", base, i, ext))
+	}
+}
+
+// throws away everything written so far
+func (output *OutputFile) Discard() {
+	output.file.Close()
+	os.Remove(output.file.Name())
+}
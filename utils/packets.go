@@ -2,17 +2,35 @@ package utils
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"net"
 )
 
 type Flags struct {
 	SYN, FIN, ACK, PSH, DUP bool
+	// aborts the connection, see ResetReason
+	RST bool
+}
+
+const MAX_SACK_BLOCKS int = 3
+
+// a range of bytes [Start, End) the receiver holds beyond the cumulative ack
+type SackBlock struct {
+	Start, End uint32
 }
 
 type Header struct {
 	Flags         Flags
 	Seq, Ack, Len uint32
+	// free space in the receiver's buffer, in bytes past Ack
+	Window uint32
+	Sack   [MAX_SACK_BLOCKS]SackBlock
+	// extensions, see RegisterOption
+	Options []Option
 }
 
 type Packet struct {
@@ -20,7 +38,86 @@ type Packet struct {
 	Header                 Header
 }
 
-func EncodePacket(header Packet) ([]byte, error) {
+// which format EncodePacket writes, DecodePacket reads both
+type Codec string
+
+const (
+	BINARY Codec = "binary"
+	// Deprecated: gob is only kept selectable for one release, use BINARY
+	GOB Codec = "gob"
+)
+
+var codec = BINARY
+
+func SetCodec(name string) error {
+	switch Codec(name) {
+	case BINARY, GOB:
+		codec = Codec(name)
+		return nil
+	}
+	return fmt.Errorf("unknown codec: %s", name)
+}
+
+const CHECKSUM_SIZE int = 4
+
+var ErrCorrupt = errors.New("packet checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// every encoded packet ends with a crc32c of everything in front of it
+func appendChecksum(encoded []byte) []byte {
+	return binary.BigEndian.AppendUint32(encoded, crc32.Checksum(encoded, castagnoli))
+}
+
+func verifyChecksum(encoded []byte) ([]byte, error) {
+	if len(encoded) < CHECKSUM_SIZE {
+		return nil, ErrCorrupt
+	}
+
+	body := encoded[:len(encoded)-CHECKSUM_SIZE]
+	if crc32.Checksum(body, castagnoli) != binary.BigEndian.Uint32(encoded[len(body):]) {
+		return nil, ErrCorrupt
+	}
+
+	return body, nil
+}
+
+func EncodePacket(packet Packet) ([]byte, error) {
+	if codec == GOB {
+		encoded, err := encodeGob(packet)
+		if err != nil {
+			return encoded, err
+		}
+		return appendChecksum(encoded), nil
+	}
+
+	encoded, err := AppendPacket(make([]byte, 0, WIRE_HEADER_SIZE+len(packet.Data)+CHECKSUM_SIZE), packet)
+	if err != nil {
+		return encoded, err
+	}
+	return appendChecksum(encoded), nil
+}
+
+// returns ErrCorrupt for packets that were damaged on the way
+func DecodePacket(encoded []byte) (Packet, error) {
+	encoded, err := verifyChecksum(encoded)
+	if err != nil {
+		return Packet{}, err
+	}
+
+	if len(encoded) > 0 && encoded[0] != WIRE_MAGIC_0 {
+		return decodeGob(encoded)
+	}
+
+	var packet Packet
+	if err := ReadPacket(encoded, &packet); err != nil {
+		return Packet{}, err
+	}
+
+	return packet, nil
+}
+
+func encodeGob(header Packet) ([]byte, error) {
 	var buffer bytes.Buffer
 	encoder := gob.NewEncoder(&buffer)
 
@@ -31,13 +128,14 @@ func EncodePacket(header Packet) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
-func DecodePacket(encoded []byte) (Packet, error) {
+func decodeGob(encoded []byte) (Packet, error) {
 	var packet Packet
 	decoder := gob.NewDecoder(bytes.NewBuffer(encoded))
 
 	if err := decoder.Decode(&packet); err != nil {
 		return Packet{}, err
 	}
+	packet.Header.Options = knownOptions(packet.Header.Options)
 
 	return packet, nil
 }
@@ -63,15 +161,17 @@ type PacketAndTime struct {
 }
 
 func Duplicates(packets []PacketAndTime) []PacketAndTime {
-	packetMap := make(map[Packet]bool)
+	// options are a slice so the packet is keyed on how it prints
+	packetMap := make(map[string]bool)
 
 	duplicatePacketAndTime := make([]PacketAndTime, 0)
 
 	for _, pkt := range packets {
-		if packetMap[pkt.Packet] {
+		key := fmt.Sprint(pkt.Packet)
+		if packetMap[key] {
 			duplicatePacketAndTime = append(duplicatePacketAndTime, pkt)
 		} else {
-			packetMap[pkt.Packet] = true
+			packetMap[key] = true
 		}
 	}
 
@@ -0,0 +1,88 @@
+package utils
+
+import "sort"
+
+// holds segments that arrived out of order until the gap before them is
+// filled, next is the sequence number of the next in-order byte expected
+type ReceiveBuffer struct {
+	Next     uint32
+	segments map[uint32]string
+}
+
+func NewReceiveBuffer(next uint32) *ReceiveBuffer {
+	return &ReceiveBuffer{Next: next, segments: make(map[uint32]string)}
+}
+
+// buffers the segment, false if every byte in it was already received
+func (buffer *ReceiveBuffer) Insert(seq uint32, data string) bool {
+	end := seq + uint32(len(data))
+	if len(data) == 0 || SeqLEQ(end, buffer.Next) {
+		return false
+	}
+
+	// trim the part that overlaps with what was already delivered
+	if SeqLT(seq, buffer.Next) {
+		data = data[buffer.Next-seq:]
+		seq = buffer.Next
+	}
+
+	if existing, ok := buffer.segments[seq]; ok && len(existing) >= len(data) {
+		return false
+	}
+
+	buffer.segments[seq] = data
+	return true
+}
+
+// removes and returns the contiguous bytes starting at next
+func (buffer *ReceiveBuffer) Read() string {
+	var data []byte
+
+	for {
+		segment, ok := buffer.segments[buffer.Next]
+		if !ok {
+			break
+		}
+
+		delete(buffer.segments, buffer.Next)
+		data = append(data, segment...)
+		buffer.Next += uint32(len(segment))
+	}
+
+	return string(data)
+}
+
+// number of out of order bytes waiting for a gap to be filled
+func (buffer *ReceiveBuffer) Buffered() int {
+	total := 0
+	for _, segment := range buffer.segments {
+		total += len(segment)
+	}
+	return total
+}
+
+// describes up to max ranges of out of order bytes the buffer is holding
+func (buffer *ReceiveBuffer) SackBlocks(max int) []SackBlock {
+	seqs := make([]uint32, 0, len(buffer.segments))
+	for seq := range buffer.segments {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return SeqLT(seqs[i], seqs[j]) })
+
+	var blocks []SackBlock
+	for _, seq := range seqs {
+		end := seq + uint32(len(buffer.segments[seq]))
+		if len(blocks) > 0 && SeqGEQ(blocks[len(blocks)-1].End, seq) {
+			if SeqGT(end, blocks[len(blocks)-1].End) {
+				blocks[len(blocks)-1].End = end
+			}
+			continue
+		}
+		if len(blocks) == max {
+			break
+		}
+		blocks = append(blocks, SackBlock{Start: seq, End: end})
+	}
+
+	return blocks
+}
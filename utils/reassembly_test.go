@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// a few segments below the 2^32 wrap, segment 2 straddles zero
+const WRAP_BASE uint32 = 0xFFFFFFFF - 249
+
+const TEST_SEGMENT_SIZE = 100
+
+func wrapSeq(segment int) uint32 {
+	return WRAP_BASE + uint32(segment*TEST_SEGMENT_SIZE)
+}
+
+func wrapData(segment int) string {
+	return strings.Repeat(string(rune('a'+segment)), TEST_SEGMENT_SIZE)
+}
+
+func TestReceiveBufferAcrossWrap(t *testing.T) {
+	type insert struct {
+		seq  uint32
+		data string
+		want bool
+	}
+
+	tests := []struct {
+		name       string
+		next       uint32
+		inserts    []insert
+		maxBlocks  int
+		wantBlocks []SackBlock
+		wantRead   string
+		wantNext   uint32
+	}{
+		{
+			name: "in order through the wrap",
+			next: WRAP_BASE,
+			inserts: []insert{
+				{wrapSeq(0), wrapData(0), true},
+				{wrapSeq(1), wrapData(1), true},
+				{wrapSeq(2), wrapData(2), true},
+				{wrapSeq(3), wrapData(3), true},
+			},
+			maxBlocks: MAX_SACK_BLOCKS,
+			wantRead:  wrapData(0) + wrapData(1) + wrapData(2) + wrapData(3),
+			wantNext:  150,
+		},
+		{
+			name: "hole before the wrap holds back the segments after it",
+			next: WRAP_BASE,
+			inserts: []insert{
+				{wrapSeq(2), wrapData(2), true},
+				{wrapSeq(3), wrapData(3), true},
+				{wrapSeq(0), wrapData(0), true},
+			},
+			maxBlocks:  MAX_SACK_BLOCKS,
+			wantBlocks: []SackBlock{{Start: wrapSeq(2), End: 150}},
+			wantRead:   wrapData(0),
+			wantNext:   wrapSeq(1),
+		},
+		{
+			name: "separate blocks on both sides of zero",
+			next: WRAP_BASE,
+			inserts: []insert{
+				{wrapSeq(1), wrapData(1), true},
+				{wrapSeq(3), wrapData(3), true},
+				{wrapSeq(5), wrapData(5), true},
+			},
+			maxBlocks:  MAX_SACK_BLOCKS,
+			wantBlocks: []SackBlock{{wrapSeq(1), wrapSeq(2)}, {wrapSeq(3), wrapSeq(4)}, {wrapSeq(5), wrapSeq(6)}},
+			wantRead:   "",
+			wantNext:   WRAP_BASE,
+		},
+		{
+			name: "blocks are capped at max, lowest first",
+			next: WRAP_BASE,
+			inserts: []insert{
+				{wrapSeq(5), wrapData(5), true},
+				{wrapSeq(1), wrapData(1), true},
+				{wrapSeq(3), wrapData(3), true},
+			},
+			maxBlocks:  2,
+			wantBlocks: []SackBlock{{wrapSeq(1), wrapSeq(2)}, {wrapSeq(3), wrapSeq(4)}},
+			wantRead:   "",
+			wantNext:   WRAP_BASE,
+		},
+		{
+			name: "segments already read are duplicates",
+			next: 50,
+			inserts: []insert{
+				{wrapSeq(1), wrapData(1), false},
+				{wrapSeq(2), wrapData(2), false},
+				{wrapSeq(3), wrapData(3), true},
+			},
+			maxBlocks: MAX_SACK_BLOCKS,
+			wantRead:  wrapData(3),
+			wantNext:  150,
+		},
+		{
+			name: "retransmit straddling zero is trimmed to the new bytes",
+			next: 0,
+			inserts: []insert{
+				{wrapSeq(2), wrapData(2), true},
+			},
+			maxBlocks: MAX_SACK_BLOCKS,
+			wantRead:  wrapData(2)[50:],
+			wantNext:  50,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buffer := NewReceiveBuffer(test.next)
+			for _, insert := range test.inserts {
+				if got := buffer.Insert(insert.seq, insert.data); got != insert.want {
+					t.Errorf("Insert(%#x) = %v, want %v", insert.seq, got, insert.want)
+				}
+			}
+
+			if got := buffer.Read(); got != test.wantRead {
+				t.Errorf("Read() returned %d bytes, want %d", len(got), len(test.wantRead))
+			}
+			// blocks only describe what is still waiting after the read
+			if got := buffer.SackBlocks(test.maxBlocks); !reflect.DeepEqual(got, test.wantBlocks) {
+				t.Errorf("SackBlocks(%d) = %v, want %v", test.maxBlocks, got, test.wantBlocks)
+			}
+			if buffer.Next != test.wantNext {
+				t.Errorf("Next = %#x, want %#x", buffer.Next, test.wantNext)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// why a connection was aborted, carried in an option on rst packets
+const OPTION_RESET_REASON OptionKind = 9
+
+func init() {
+	RegisterOption(OPTION_RESET_REASON, OptionCodec{Name: "reset reason", Size: 1})
+}
+
+type ResetReason uint8
+
+const (
+	RESET_UNSPECIFIED ResetReason = iota
+	RESET_UNKNOWN_CONNECTION
+	RESET_POLICY_REJECTED
+	RESET_DISK_FULL
+	RESET_PROTOCOL_VIOLATION
+	RESET_TIMEOUT
+	RESET_LOCAL_ERROR
+)
+
+var ErrReset = errors.New("connection reset by peer")
+
+func (reason ResetReason) String() string {
+	switch reason {
+	case RESET_UNSPECIFIED:
+		return "unspecified"
+	case RESET_UNKNOWN_CONNECTION:
+		return "unknown connection"
+	case RESET_POLICY_REJECTED:
+		return "policy rejected"
+	case RESET_DISK_FULL:
+		return "disk full"
+	case RESET_PROTOCOL_VIOLATION:
+		return "protocol violation"
+	case RESET_TIMEOUT:
+		return "timeout"
+	case RESET_LOCAL_ERROR:
+		return "local error"
+	}
+	return fmt.Sprintf("reason %d", uint8(reason))
+}
+
+// the reason for a file or negotiation error that ends a transfer
+func ResetReasonFor(err error) ResetReason {
+	if errors.Is(err, ErrFileExists) || errors.Is(err, os.ErrPermission) || errors.Is(err, ErrSmallDatagram) {
+		return RESET_POLICY_REJECTED
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return RESET_DISK_FULL
+	}
+	return RESET_LOCAL_ERROR
+}
+
+// unspecified when the rst did not say why
+func (header *Header) ResetReason() ResetReason {
+	data, ok := header.Option(OPTION_RESET_REASON)
+	if !ok || len(data) != 1 {
+		return RESET_UNSPECIFIED
+	}
+	return ResetReason(data[0])
+}
+
+func (header *Header) SetResetReason(reason ResetReason) {
+	header.SetOption(OPTION_RESET_REASON, []byte{byte(reason)})
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	INITIAL_RTO = 1 * time.Second
+	MIN_RTO     = 200 * time.Millisecond
+	MAX_RTO     = 60 * time.Second
+
+	// clock granularity from RFC 6298, keeps rto above srtt when rttvar is 0
+	RTO_GRANULARITY = 1 * time.Millisecond
+)
+
+// retransmission timeout estimation from RFC 6298, callers are responsible for
+// karn's rule and must not sample segments that were retransmitted
+type RTOEstimator struct {
+	SRTT, RTTVAR, RTO time.Duration
+	Min, Max          time.Duration
+	sampled           bool
+}
+
+func NewRTOEstimator() *RTOEstimator {
+	return &RTOEstimator{RTO: INITIAL_RTO, Min: MIN_RTO, Max: MAX_RTO}
+}
+
+func (estimator *RTOEstimator) Sample(rtt time.Duration) {
+	if !estimator.sampled {
+		estimator.SRTT = rtt
+		estimator.RTTVAR = rtt / 2
+		estimator.sampled = true
+	} else {
+		delta := estimator.SRTT - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		estimator.RTTVAR = (3*estimator.RTTVAR + delta) / 4
+		estimator.SRTT = (7*estimator.SRTT + rtt) / 8
+	}
+
+	estimator.RTO = estimator.clamp(estimator.SRTT + max(RTO_GRANULARITY, 4*estimator.RTTVAR))
+}
+
+// doubles the timeout after a retransmission timer expires
+func (estimator *RTOEstimator) Backoff() {
+	estimator.RTO = estimator.clamp(2 * estimator.RTO)
+}
+
+func (estimator *RTOEstimator) clamp(rto time.Duration) time.Duration {
+	return min(max(rto, estimator.Min), estimator.Max)
+}
+
+func (estimator *RTOEstimator) String() string {
+	return fmt.Sprintf("RTO: %v (SRTT: %v, RTTVAR: %v)", estimator.RTO, estimator.SRTT, estimator.RTTVAR)
+}
@@ -0,0 +1,34 @@
+package utils
+
+import "math/rand"
+
+// serial number arithmetic from RFC 1982, sequence numbers are compared by
+// their distance so the comparisons keep working across the 2^32 wrap
+
+func SeqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func SeqLEQ(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+func SeqGT(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+func SeqGEQ(a, b uint32) bool {
+	return int32(a-b) >= 0
+}
+
+// whether seq falls from next up to size past it, the end included so a zero
+// window still takes a segment at next
+func SeqInWindow(seq, next, size uint32) bool {
+	return SeqGEQ(seq, next) && SeqLEQ(seq, next+size)
+}
+
+// a random initial sequence number makes a late packet from an earlier
+// connection unlikely to land inside the window of a new one
+func RandomISN() uint32 {
+	return rand.Uint32()
+}
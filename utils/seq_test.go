@@ -0,0 +1,63 @@
+package utils
+
+import "testing"
+
+func TestSeqComparisonsAcrossWrap(t *testing.T) {
+	tests := []struct {
+		name             string
+		a, b             uint32
+		lt, leq, gt, geq bool
+	}{
+		{"equal", 10, 10, false, true, false, true},
+		{"equal at the top", 0xFFFFFFFF, 0xFFFFFFFF, false, true, false, true},
+		{"plain less", 10, 20, true, true, false, false},
+		{"plain greater", 20, 10, false, false, true, true},
+		{"last before wrap is less than zero", 0xFFFFFFFF, 0, true, true, false, false},
+		{"zero is greater than last before wrap", 0, 0xFFFFFFFF, false, false, true, true},
+		{"below the wrap is less than past it", 0xFFFFFF00, 0x100, true, true, false, false},
+		{"past the wrap is greater than below it", 0x100, 0xFFFFFF00, false, false, true, true},
+		{"just under half the space", 0, 0x7FFFFFFF, true, true, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := SeqLT(test.a, test.b); got != test.lt {
+				t.Errorf("SeqLT(%#x, %#x) = %v, want %v", test.a, test.b, got, test.lt)
+			}
+			if got := SeqLEQ(test.a, test.b); got != test.leq {
+				t.Errorf("SeqLEQ(%#x, %#x) = %v, want %v", test.a, test.b, got, test.leq)
+			}
+			if got := SeqGT(test.a, test.b); got != test.gt {
+				t.Errorf("SeqGT(%#x, %#x) = %v, want %v", test.a, test.b, got, test.gt)
+			}
+			if got := SeqGEQ(test.a, test.b); got != test.geq {
+				t.Errorf("SeqGEQ(%#x, %#x) = %v, want %v", test.a, test.b, got, test.geq)
+			}
+		})
+	}
+}
+
+func TestSeqInWindowAcrossWrap(t *testing.T) {
+	tests := []struct {
+		name            string
+		seq, next, size uint32
+		want            bool
+	}{
+		{"at next", 100, 100, 50, true},
+		{"at the end", 150, 100, 50, true},
+		{"before next", 99, 100, 50, false},
+		{"past the end", 151, 100, 50, false},
+		{"zero window takes next", 100, 100, 0, true},
+		{"zero window takes nothing else", 101, 100, 0, false},
+		{"window across the wrap", 0x10, 0xFFFFFFF0, 0x40, true},
+		{"past a window across the wrap", 0x31, 0xFFFFFFF0, 0x40, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := SeqInWindow(test.seq, test.next, test.size); got != test.want {
+				t.Errorf("SeqInWindow(%#x, %#x, %#x) = %v, want %v", test.seq, test.next, test.size, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"comp7005_project/fsm"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// connection states, named after tcp's. FIN_WAIT stands for both FIN_WAIT_1
+// and FIN_WAIT_2 since the client handles the ack of its fin and the server's
+// reply in the same place
+const (
+	CLOSED      = "CLOSED"
+	SYN_SENT    = "SYN_SENT"
+	SYN_RCVD    = "SYN_RCVD"
+	ESTABLISHED = "ESTABLISHED"
+	FIN_WAIT    = "FIN_WAIT"
+	CLOSE_WAIT  = "CLOSE_WAIT"
+	LAST_ACK    = "LAST_ACK"
+	TIME_WAIT   = "TIME_WAIT"
+)
+
+// runs a packet or timeout event through the connection's state machine and
+// logs the state change. an event the current state does not allow returns the
+// fsm's error and leaves the state as it was
+func Step(machine *fsm.FSM, event string) error {
+	from := machine.Current()
+	if err := machine.Transition(context.Background(), event); err != nil {
+		return fmt.Errorf("%s in %s: %w", event, from, err)
+	}
+
+	if to := machine.Current(); to != from {
+		fmt.Printf("State: %s -> %s (%s)\n", from, to, event)
+	}
+	return nil
+}
+
+// writes the state machine to dir as <name>.gv and <name>.mmd so the diagrams
+// are made from the same transitions the connections run on
+func WriteDiagrams(machine *fsm.FSM, dir string, name string) error {
+	dot, err := os.Create(filepath.Join(dir, name+".gv"))
+	if err != nil {
+		return err
+	}
+	defer dot.Close()
+	if err := machine.Dot(dot, name); err != nil {
+		return err
+	}
+
+	mermaid, err := os.Create(filepath.Join(dir, name+".mmd"))
+	if err != nil {
+		return err
+	}
+	defer mermaid.Close()
+	return machine.Mermaid(mermaid)
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// TSval and TSecr from RFC 7323, the sender's clock and the last value it
+// received from the peer, echoed back so every ack is a round trip sample
+const OPTION_TIMESTAMP OptionKind = 8
+
+func init() {
+	RegisterOption(OPTION_TIMESTAMP, OptionCodec{Name: "timestamp", Size: 8})
+}
+
+type Timestamp struct {
+	Val, Ecr uint32
+}
+
+// timestamps count milliseconds from when the process started, starting at 1
+// so an echo of 0 always means there was nothing to echo
+var timestampEpoch = time.Now().Add(-time.Millisecond)
+
+func TimestampNow() uint32 {
+	return uint32(time.Since(timestampEpoch).Milliseconds())
+}
+
+// the time since a timestamp this side sent was echoed back, false when the
+// echo is ahead of the clock so it cannot have come from this side
+func TimestampRTT(ecr uint32) (time.Duration, bool) {
+	now := TimestampNow()
+	if ecr == 0 || SeqGT(ecr, now) {
+		return 0, false
+	}
+	return time.Duration(now-ecr) * time.Millisecond, true
+}
+
+// PAWS, a segment whose timestamp is older than the last one accepted is an
+// old duplicate even when its sequence number looks valid
+func StaleTimestamp(val, recent uint32) bool {
+	return SeqLT(val, recent)
+}
+
+func (header *Header) Timestamp() (Timestamp, bool) {
+	data, ok := header.Option(OPTION_TIMESTAMP)
+	if !ok || len(data) != 8 {
+		return Timestamp{}, false
+	}
+	return Timestamp{Val: binary.BigEndian.Uint32(data[0:4]), Ecr: binary.BigEndian.Uint32(data[4:8])}, true
+}
+
+func (header *Header) SetTimestamp(timestamp Timestamp) {
+	data := binary.BigEndian.AppendUint32(make([]byte, 0, 8), timestamp.Val)
+	header.SetOption(OPTION_TIMESTAMP, binary.BigEndian.AppendUint32(data, timestamp.Ecr))
+}
+
+// a round trip seen by the proxy between a timestamp passing through and its
+// echo coming back
+type RTTAndTime struct {
+	Time float64
+	RTT  time.Duration
+}
@@ -0,0 +1,129 @@
+package utils
+
+import "time"
+
+// number of segments that have to be sacked past a hole before it is
+// treated as lost instead of reordered
+const SACK_LOSS_THRESHOLD int = 3
+
+type Segment struct {
+	Packet        Packet
+	SentAt        time.Time
+	Retransmitted bool
+	Sacked        bool
+}
+
+// end is the sequence number right after the last byte in the segment
+func (segment *Segment) end() uint32 {
+	return segment.Packet.Header.Seq + segment.Packet.Header.Len
+}
+
+// keeps track of the segments that are in flight, base is the oldest
+// unacknowledged segment and next is the first segment that has not been sent,
+// the receiver takes bytes up to but not including the right edge
+type SendWindow struct {
+	Segments   []Segment
+	Base, Next int
+	Size       int
+
+	RightEdge  uint32
+	lastAck    uint32
+	advertised bool
+}
+
+func NewSendWindow(packets []Packet, size int) *SendWindow {
+	segments := make([]Segment, len(packets))
+	for i, packet := range packets {
+		segments[i] = Segment{Packet: packet}
+	}
+
+	return &SendWindow{Segments: segments, Size: size}
+}
+
+func (window *SendWindow) Done() bool {
+	return window.Base >= len(window.Segments)
+}
+
+func (window *SendWindow) InFlight() int {
+	return window.Next - window.Base
+}
+
+func (window *SendWindow) CanSend() bool {
+	return window.Next < len(window.Segments) && window.InFlight() < window.Size && SeqLEQ(window.Segments[window.Next].end(), window.RightEdge)
+}
+
+// true when the only thing stopping the next segment is the receiver's window
+func (window *SendWindow) Closed() bool {
+	return window.Next < len(window.Segments) && window.InFlight() == 0 && !window.CanSend()
+}
+
+// moves the right edge to what the receiver advertised in its latest ack, acks
+// that arrive out of order are ignored so an old window is never applied
+func (window *SendWindow) Advertise(ack uint32, size uint32) {
+	if window.advertised && SeqLT(ack, window.lastAck) {
+		return
+	}
+
+	window.advertised = true
+	window.lastAck = ack
+	window.RightEdge = ack + size
+}
+
+// returns the next unsent segment and moves it into the window
+func (window *SendWindow) Take() *Segment {
+	segment := &window.Segments[window.Next]
+	window.Next++
+	return segment
+}
+
+func (window *SendWindow) Oldest() *Segment {
+	if window.Done() {
+		return nil
+	}
+	return &window.Segments[window.Base]
+}
+
+// slides the window past every segment covered by the cumulative ack and
+// returns the segments that were acknowledged, oldest first
+func (window *SendWindow) Ack(ack uint32) []*Segment {
+	var acked []*Segment
+	for window.Base < window.Next && SeqLEQ(window.Segments[window.Base].end(), ack) {
+		acked = append(acked, &window.Segments[window.Base])
+		window.Base++
+	}
+	return acked
+}
+
+// marks the segments in flight that are covered by the receiver's sack blocks
+func (window *SendWindow) Sack(blocks [MAX_SACK_BLOCKS]SackBlock) {
+	for _, block := range blocks {
+		if block.Start == block.End {
+			continue
+		}
+
+		for i := window.Base; i < window.Next; i++ {
+			segment := &window.Segments[i]
+			if SeqLEQ(block.Start, segment.Packet.Header.Seq) && SeqLEQ(segment.end(), block.End) {
+				segment.Sacked = true
+			}
+		}
+	}
+}
+
+// returns the segments in flight that the receiver has not sacked even though
+// enough segments sent after them were, these are the holes worth resending
+func (window *SendWindow) Missing() []*Segment {
+	var missing []*Segment
+
+	sackedAfter := 0
+	for i := window.Next - 1; i >= window.Base; i-- {
+		segment := &window.Segments[i]
+		if segment.Sacked {
+			sackedAfter++
+		} else if sackedAfter >= SACK_LOSS_THRESHOLD {
+			missing = append([]*Segment{segment}, missing...)
+		}
+	}
+
+	return missing
+}
@@ -0,0 +1,141 @@
+package utils
+
+import "testing"
+
+// six segments starting a few below the 2^32 wrap
+func wrapPackets() []Packet {
+	packets := make([]Packet, 6)
+	for i := range packets {
+		packets[i] = Packet{Data: wrapData(i), Header: Header{Seq: wrapSeq(i), Len: TEST_SEGMENT_SIZE}}
+	}
+	return packets
+}
+
+// a window with every one of the wrap segments in flight
+func wrapWindow() *SendWindow {
+	window := NewSendWindow(wrapPackets(), 6)
+	for window.Next < len(window.Segments) {
+		window.Take()
+	}
+	return window
+}
+
+func TestSendWindowAckAcrossWrap(t *testing.T) {
+	tests := []struct {
+		name      string
+		acks      []uint32
+		wantAcked int
+		wantBase  int
+	}{
+		{"ack below the wrap", []uint32{wrapSeq(2)}, 2, 2},
+		{"ack past the wrap", []uint32{50}, 3, 3},
+		{"ack at zero is inside the straddling segment", []uint32{0}, 2, 2},
+		{"older ack after a newer one does nothing", []uint32{150, wrapSeq(1)}, 4, 4},
+		{"ack for everything", []uint32{wrapSeq(6)}, 6, 6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			window := wrapWindow()
+			acked := 0
+			for _, ack := range test.acks {
+				acked += len(window.Ack(ack))
+			}
+
+			if acked != test.wantAcked {
+				t.Errorf("acked %d segments, want %d", acked, test.wantAcked)
+			}
+			if window.Base != test.wantBase {
+				t.Errorf("Base = %d, want %d", window.Base, test.wantBase)
+			}
+		})
+	}
+}
+
+func TestSendWindowSackAcrossWrap(t *testing.T) {
+	tests := []struct {
+		name        string
+		blocks      [MAX_SACK_BLOCKS]SackBlock
+		wantSacked  []bool
+		wantMissing []int
+	}{
+		{
+			name:        "block straddling zero",
+			blocks:      [MAX_SACK_BLOCKS]SackBlock{{wrapSeq(2), wrapSeq(5)}},
+			wantSacked:  []bool{false, false, true, true, true, false},
+			wantMissing: []int{0, 1},
+		},
+		{
+			name:        "blocks on both sides of zero",
+			blocks:      [MAX_SACK_BLOCKS]SackBlock{{wrapSeq(1), wrapSeq(2)}, {wrapSeq(3), wrapSeq(6)}},
+			wantSacked:  []bool{false, true, false, true, true, true},
+			wantMissing: []int{0, 2},
+		},
+		{
+			name:        "block ending inside the straddling segment does not cover it",
+			blocks:      [MAX_SACK_BLOCKS]SackBlock{{wrapSeq(1), 0}},
+			wantSacked:  []bool{false, true, false, false, false, false},
+			wantMissing: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			window := wrapWindow()
+			window.Sack(test.blocks)
+
+			for i, want := range test.wantSacked {
+				if window.Segments[i].Sacked != want {
+					t.Errorf("segment %d Sacked = %v, want %v", i, window.Segments[i].Sacked, want)
+				}
+			}
+
+			missing := window.Missing()
+			if len(missing) != len(test.wantMissing) {
+				t.Fatalf("Missing() returned %d segments, want %d", len(missing), len(test.wantMissing))
+			}
+			for i, segment := range missing {
+				if want := wrapSeq(test.wantMissing[i]); segment.Packet.Header.Seq != want {
+					t.Errorf("missing segment %d starts at %#x, want %#x", i, segment.Packet.Header.Seq, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSendWindowAdvertiseAcrossWrap(t *testing.T) {
+	type advertisement struct {
+		ack, size uint32
+	}
+
+	tests := []struct {
+		name          string
+		advertised    []advertisement
+		wantRightEdge uint32
+		wantCanSend   bool
+	}{
+		{"edge before the wrap", []advertisement{{WRAP_BASE, 100}}, wrapSeq(1), true},
+		{"edge carried past zero", []advertisement{{WRAP_BASE, 400}}, 150, true},
+		{"ack past zero replaces one before it", []advertisement{{WRAP_BASE, 100}, {50, 0}}, 50, true},
+		{"ack before zero arriving late is ignored", []advertisement{{50, 200}, {WRAP_BASE, 100}}, 250, true},
+		{"zero window", []advertisement{{WRAP_BASE, 0}}, WRAP_BASE, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// nothing sent yet so CanSend checks the first segment against the edge
+			window := NewSendWindow(wrapPackets(), 6)
+
+			for _, advertised := range test.advertised {
+				window.Advertise(advertised.ack, advertised.size)
+			}
+
+			if window.RightEdge != test.wantRightEdge {
+				t.Errorf("RightEdge = %#x, want %#x", window.RightEdge, test.wantRightEdge)
+			}
+			if got := window.CanSend(); got != test.wantCanSend {
+				t.Errorf("CanSend() = %v, want %v", got, test.wantCanSend)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// binary packet layout, every integer is big endian
+//
+//	magic      2 bytes  0xC7 0x05
+//	version    1 byte
+//	flags      1 byte   SYN, FIN, ACK, PSH, DUP, RST from the lowest bit up
+//	seq        4 bytes
+//	ack        4 bytes
+//	len        4 bytes
+//	window     4 bytes
+//	src addr  18 bytes  16 byte ip (ipv4 is mapped) and 2 byte port
+//	dst addr  18 bytes
+//	sack       1 byte count followed by count 8 byte start/end pairs
+//	options    1 byte length followed by that many bytes of 1 byte kind,
+//	           1 byte length and value entries, unknown kinds are skipped
+//	data       2 byte length followed by the payload
+//
+// EncodePacket adds a 4 byte crc32c after this, the same as it does for gob.
+// gob streams never start with 0xC7 so both formats can be told apart by the
+// first byte
+const (
+	WIRE_MAGIC_0 byte = 0xC7
+	WIRE_MAGIC_1 byte = 0x05
+	WIRE_VERSION byte = 1
+
+	WIRE_HEADER_SIZE int = 2 + 1 + 1 + 4 + 4 + 4 + 4 + 18 + 18 + 1 + 1 + 2
+	WIRE_MAX_SIZE    int = WIRE_HEADER_SIZE + MAX_SACK_BLOCKS*8 + MAX_OPTIONS_SIZE + 0xFFFF + CHECKSUM_SIZE
+)
+
+const (
+	FLAG_SYN byte = 1 << iota
+	FLAG_FIN
+	FLAG_ACK
+	FLAG_PSH
+	FLAG_DUP
+	FLAG_RST
+)
+
+var (
+	ErrShortPacket = errors.New("packet is shorter than its header")
+	ErrBadVersion  = errors.New("unsupported packet version")
+)
+
+func flagsToByte(flags Flags) byte {
+	var bits byte
+	if flags.SYN {
+		bits |= FLAG_SYN
+	}
+	if flags.FIN {
+		bits |= FLAG_FIN
+	}
+	if flags.ACK {
+		bits |= FLAG_ACK
+	}
+	if flags.PSH {
+		bits |= FLAG_PSH
+	}
+	if flags.DUP {
+		bits |= FLAG_DUP
+	}
+	if flags.RST {
+		bits |= FLAG_RST
+	}
+	return bits
+}
+
+func byteToFlags(bits byte) Flags {
+	return Flags{
+		SYN: bits&FLAG_SYN != 0,
+		FIN: bits&FLAG_FIN != 0,
+		ACK: bits&FLAG_ACK != 0,
+		PSH: bits&FLAG_PSH != 0,
+		DUP: bits&FLAG_DUP != 0,
+		RST: bits&FLAG_RST != 0,
+	}
+}
+
+func appendAddr(dst []byte, address string) ([]byte, error) {
+	var addrPort netip.AddrPort
+	if address != "" {
+		parsed, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return dst, err
+		}
+		addrPort = parsed
+	}
+
+	var ip [16]byte
+	if addrPort.Addr().IsValid() {
+		ip = addrPort.Addr().As16()
+	}
+
+	dst = append(dst, ip[:]...)
+	return binary.BigEndian.AppendUint16(dst, addrPort.Port()), nil
+}
+
+func readAddr(src []byte) string {
+	port := binary.BigEndian.Uint16(src[16:18])
+	ip := netip.AddrFrom16([16]byte(src[0:16])).Unmap()
+
+	if ip.IsUnspecified() && port == 0 {
+		return ""
+	}
+	return netip.AddrPortFrom(ip, port).String()
+}
+
+// appends the binary form of the packet to dst, so callers can reuse a buffer
+func AppendPacket(dst []byte, packet Packet) ([]byte, error) {
+	if len(packet.Data) > 0xFFFF {
+		return dst, fmt.Errorf("payload of %d bytes is too large", len(packet.Data))
+	}
+
+	dst = append(dst, WIRE_MAGIC_0, WIRE_MAGIC_1, WIRE_VERSION, flagsToByte(packet.Header.Flags))
+	dst = binary.BigEndian.AppendUint32(dst, packet.Header.Seq)
+	dst = binary.BigEndian.AppendUint32(dst, packet.Header.Ack)
+	dst = binary.BigEndian.AppendUint32(dst, packet.Header.Len)
+	dst = binary.BigEndian.AppendUint32(dst, packet.Header.Window)
+
+	var err error
+	if dst, err = appendAddr(dst, packet.SrcAddr); err != nil {
+		return dst, err
+	}
+	if dst, err = appendAddr(dst, packet.DstAddr); err != nil {
+		return dst, err
+	}
+
+	countAt := len(dst)
+	dst = append(dst, 0)
+	for _, block := range packet.Header.Sack {
+		if block.Start == block.End {
+			continue
+		}
+		dst = binary.BigEndian.AppendUint32(dst, block.Start)
+		dst = binary.BigEndian.AppendUint32(dst, block.End)
+		dst[countAt]++
+	}
+
+	if dst, err = appendOptions(dst, packet.Header.Options); err != nil {
+		return dst, err
+	}
+
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(packet.Data)))
+	return append(dst, packet.Data...), nil
+}
+
+// decodes the binary form of a packet into packet
+func ReadPacket(src []byte, packet *Packet) error {
+	if len(src) < WIRE_HEADER_SIZE {
+		return ErrShortPacket
+	}
+	if src[0] != WIRE_MAGIC_0 || src[1] != WIRE_MAGIC_1 || src[2] != WIRE_VERSION {
+		return ErrBadVersion
+	}
+
+	packet.Header = Header{
+		Flags:  byteToFlags(src[3]),
+		Seq:    binary.BigEndian.Uint32(src[4:8]),
+		Ack:    binary.BigEndian.Uint32(src[8:12]),
+		Len:    binary.BigEndian.Uint32(src[12:16]),
+		Window: binary.BigEndian.Uint32(src[16:20]),
+	}
+	packet.SrcAddr = readAddr(src[20:38])
+	packet.DstAddr = readAddr(src[38:56])
+
+	count := int(src[56])
+	offset := 57
+	if count > MAX_SACK_BLOCKS || len(src) < WIRE_HEADER_SIZE+count*8 {
+		return ErrShortPacket
+	}
+	for i := 0; i < count; i++ {
+		packet.Header.Sack[i] = SackBlock{
+			Start: binary.BigEndian.Uint32(src[offset : offset+4]),
+			End:   binary.BigEndian.Uint32(src[offset+4 : offset+8]),
+		}
+		offset += 8
+	}
+
+	size := int(src[offset])
+	offset++
+	if len(src) < offset+size+2 {
+		return ErrShortPacket
+	}
+	options, err := readOptions(src[offset : offset+size])
+	if err != nil {
+		return err
+	}
+	packet.Header.Options = options
+	offset += size
+
+	length := int(binary.BigEndian.Uint16(src[offset : offset+2]))
+	offset += 2
+	if len(src) < offset+length {
+		return ErrShortPacket
+	}
+	packet.Data = string(src[offset : offset+length])
+
+	return nil
+}
+
+func appendOptions(dst []byte, options []Option) ([]byte, error) {
+	sizeAt := len(dst)
+	dst = append(dst, 0)
+
+	for _, option := range options {
+		if len(option.Data) > 0xFF {
+			return dst, fmt.Errorf("option %d is too large", option.Kind)
+		}
+		dst = append(dst, byte(option.Kind), byte(len(option.Data)))
+		dst = append(dst, option.Data...)
+	}
+
+	size := len(dst) - sizeAt - 1
+	if size > MAX_OPTIONS_SIZE {
+		return dst, fmt.Errorf("%d bytes of options is too large", size)
+	}
+	dst[sizeAt] = byte(size)
+	return dst, nil
+}
+
+// options are kept in the order they were sent, ones this side has no codec
+// for are skipped
+func readOptions(src []byte) ([]Option, error) {
+	var options []Option
+
+	for offset := 0; offset < len(src); {
+		if src[offset] == 0 {
+			offset++
+			continue
+		}
+		if offset+2 > len(src) || offset+2+int(src[offset+1]) > len(src) {
+			return nil, ErrShortPacket
+		}
+
+		kind := OptionKind(src[offset])
+		size := int(src[offset+1])
+		options = append(options, Option{Kind: kind, Data: append([]byte(nil), src[offset+2:offset+2+size]...)})
+		offset += 2 + size
+	}
+
+	return knownOptions(options), nil
+}